@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The admin API lets admins see and control the instances of the apps:
+//
+//	GET  /apps                 status of all apps
+//	GET  /apps/:name           status of an app
+//	POST /apps/:name/launch    launch the instance
+//	POST /apps/:name/stop      stop the instance
+//	POST /apps/:name/terminate terminate the instance
+//	POST /apps/:name/restart   shut down the instance and launch it again
+//	POST /apps/:name/extend    postpone the idle shutdown by duration
+//	POST /apps/:name/flush     forget the cached target
+//
+// Actions answer with the status of the app afterwards. Scripts authenticate
+// with API tokens or basic auth; actions with the session cookie need an
+// X-Requested-With header or a JSON content type, see requireNonSimple.
+func (r *Router) RegisterApi(g *echo.Group) {
+	g.GET("/apps", r.apiApps())
+	g.GET("/apps/:name", r.apiApp())
+	g.POST("/apps/:name/:action", r.apiAction())
+}
+
+// requireNonSimple protects the API from cross-site requests. Browsers send
+// the session cookie with forms posted from other sites, but such forms
+// cannot set headers or send JSON without a CORS preflight, which the API
+// does not allow.
+func requireNonSimple() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if c.Get("AuthMethod") != authMethodCookie || req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+				return next(c)
+			}
+
+			contentType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+			if req.Header.Get(echo.HeaderXRequestedWith) == "" && contentType != echo.MIMEApplicationJSON {
+				c.Logger().Warnf("Rejected %s %s with the session cookie of %v without X-Requested-With", req.Method, req.URL.Path, c.Get("Username"))
+				return echo.NewHTTPError(http.StatusForbidden, "requests with the session cookie need an X-Requested-With header or a JSON body")
+			}
+			return next(c)
+		}
+	}
+}
+
+func (r *Router) apiLauncher(c echo.Context) (*Launcher, error) {
+	app := r.App(c.Param("name"))
+	if app == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "unknown app")
+	}
+	return app.Launcher, nil
+}
+
+func apiError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "no instance is running").SetInternal(err)
+	case errors.Is(err, errPending):
+		return echo.NewHTTPError(http.StatusAccepted, "the instance is starting").SetInternal(err)
+	case errors.Is(err, errNotIdleAlarm):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
+
+// runAction runs an action of the API on the app of the launcher, and turns
+// errors into HTTP errors.
+func runAction(c echo.Context, l *Launcher, action string) error {
+	c.Logger().Infof("%v requested %s of app %s", c.Get("Username"), action, c.Param("name"))
+
+	var err error
+	switch action {
+	case "launch":
+		_, _, err = l.LaunchInstance(c)
+	case "stop":
+		err = l.Shutdown(c, IdleActionStop)
+	case "terminate":
+		err = l.Shutdown(c, IdleActionTerminate)
+	case "restart":
+		_, err = l.Restart(c)
+	case "extend":
+		var d time.Duration
+		if s := c.FormValue("duration"); s != "" {
+			if d, err = time.ParseDuration(s); err != nil || d < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "duration must be a positive duration such as 30m")
+			}
+		}
+		err = l.Extend(c, d)
+	case "flush":
+		l.Flush()
+	default:
+		return echo.NewHTTPError(http.StatusNotFound, "unknown action")
+	}
+	return apiError(err)
+}
+
+func (r *Router) apiApps() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		statuses := []*AppStatus{}
+		for _, app := range r.Apps() {
+			status, err := app.Launcher.Status(c)
+			if err != nil {
+				return err
+			}
+			statuses = append(statuses, status)
+		}
+		return c.JSON(http.StatusOK, statuses)
+	}
+}
+
+func (r *Router) apiApp() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l, err := r.apiLauncher(c)
+		if err != nil {
+			return err
+		}
+
+		status, err := l.Status(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+func (r *Router) apiAction() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l, err := r.apiLauncher(c)
+		if err != nil {
+			return err
+		}
+
+		if err := runAction(c, l, c.Param("action")); err != nil {
+			return err
+		}
+
+		status, err := l.Status(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, status)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequireNonSimple(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		authMethod  string
+		contentType string
+		requestedBy string
+		allowed     bool
+	}{
+		{"cookie get", http.MethodGet, authMethodCookie, "", "", true},
+		{"cookie form post", http.MethodPost, authMethodCookie, echo.MIMEApplicationForm, "", false},
+		{"cookie plain post", http.MethodPost, authMethodCookie, echo.MIMETextPlain, "", false},
+		{"cookie empty post", http.MethodPost, authMethodCookie, "", "", false},
+		{"cookie json post", http.MethodPost, authMethodCookie, "application/json; charset=utf-8", "", true},
+		{"cookie xhr post", http.MethodPost, authMethodCookie, "", "XMLHttpRequest", true},
+		{"api token post", http.MethodPost, authMethodApi, echo.MIMEApplicationForm, "", true},
+		{"basic auth post", http.MethodPost, authMethodBasic, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/.launcher/api/apps/sd/stop", nil)
+			if tt.contentType != "" {
+				req.Header.Set(echo.HeaderContentType, tt.contentType)
+			}
+			if tt.requestedBy != "" {
+				req.Header.Set(echo.HeaderXRequestedWith, tt.requestedBy)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("AuthMethod", tt.authMethod)
+
+			called := false
+			err := requireNonSimple()(func(c echo.Context) error {
+				called = true
+				return nil
+			})(c)
+			if called != tt.allowed {
+				t.Fatalf("handler called %v, want %v", called, tt.allowed)
+			}
+			if !tt.allowed && httpErrorCode(err) != http.StatusForbidden {
+				t.Fatalf("got error %v, want forbidden", err)
+			}
+		})
+	}
+}
+
+func TestApiReservedWithoutAuth(t *testing.T) {
+	e := echo.New()
+	e.Group("/.launcher/api", RequireAuth("API"))
+	proxied := false
+	e.Group("").Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			proxied = true
+			return c.NoContent(http.StatusOK)
+		}
+	})
+
+	for _, path := range []string{"/.launcher/api", "/.launcher/api/apps", "/.launcher/api/apps/sd/launch", "/.launcher/api/other"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			if rec.Code != http.StatusForbidden || proxied {
+				t.Fatalf("%s %s answered %d, proxied %v", method, path, rec.Code, proxied)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if !proxied {
+		t.Fatalf("other paths are not proxied, got %d", rec.Code)
+	}
+}
+
+func TestApiError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{errNotFound, http.StatusNotFound},
+		{errPending, http.StatusAccepted},
+		{errNotIdleAlarm, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		err := apiError(tt.err)
+		if code := httpErrorCode(err); code != tt.code {
+			t.Errorf("apiError(%v) has status %d, want %d", tt.err, code, tt.code)
+		}
+		if tt.err != errNotIdleAlarm && !errors.Is(err, tt.err) {
+			t.Errorf("apiError(%v) does not wrap it", tt.err)
+		}
+	}
+	if apiError(nil) != nil {
+		t.Error("apiError(nil) is not nil")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const apiTokenPrefix = "lch_"
+
+type ApiToken struct {
+	Name     string
+	Username string
+}
+
+// ApiTokens holds the long-lived tokens of a file with one
+// "name:username:sha256" entry per line. Only hashes are kept in the file, and
+// a token is revoked by removing its line and reloading the config.
+type ApiTokens struct {
+	tokens map[string]*ApiToken
+}
+
+func LoadApiTokensFile(path string) (*ApiTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open api tokens file: %w", err)
+	}
+	defer f.Close()
+
+	at := &ApiTokens{tokens: make(map[string]*ApiToken)}
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || len(parts[2]) != 64 {
+			return nil, fmt.Errorf("%s:%d: expected name:username:sha256", path, n)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("%s:%d: token %s is defined more than once", path, n, parts[0])
+		}
+		names[parts[0]] = true
+
+		at.tokens[strings.ToLower(parts[2])] = &ApiToken{
+			Name:     parts[0],
+			Username: parts[1],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read api tokens file: %w", err)
+	}
+
+	return at, nil
+}
+
+// Lookup finds a token by its hash, so the comparison does not leak the
+// token through timing.
+func (at *ApiTokens) Lookup(token string) (*ApiToken, bool) {
+	t, ok := at.tokens[tokenKey(token)]
+	return t, ok
+}
+
+// NewApiToken returns a new token and its line for the api tokens file.
+func NewApiToken(name, username string) (string, string, error) {
+	if name == "" || username == "" || strings.Contains(name+username, ":") {
+		return "", "", fmt.Errorf("name and username must be set and must not contain ':'")
+	}
+
+	token, err := newTokenString()
+	if err != nil {
+		return "", "", err
+	}
+	token = apiTokenPrefix + token
+
+	return token, fmt.Sprintf("%s:%s:%s", name, username, tokenKey(token)), nil
+}
@@ -1,47 +1,214 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 const (
 	authCookieName = "LAUNCHER_AUTH"
+	csrfCookieName = "LAUNCHER_CSRF"
 	tokenTtl       = 1800 * time.Second
+	sessionMaxAge  = 24 * time.Hour
+	verifyPath     = "/verify"
+	logoutPath     = "/logout"
+	sessionsPath   = "/sessions"
+)
+
+// How the user of a request is authenticated, kept as AuthMethod.
+const (
+	authMethodApi    = "api"
+	authMethodBasic  = "basic"
+	authMethodHeader = "header"
+	authMethodCookie = "cookie"
 )
 
 func AuthPage(config *Config) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		redirect := c.QueryParam("redirect_uri")
+		csrf, _ := c.Get("csrf").(string)
+		return c.Render(http.StatusOK, "AuthTemplate", LoginPageParams{
+			Path: loginPath(config.AuthConfig.AuthPath, c.QueryParam("redirect_uri")),
+			Csrf: csrf,
+		})
+	}
+}
 
-		path := config.AuthConfig.AuthPath
-		if redirect != "" {
-			path = fmt.Sprintf("%v?redirect_uri=%v", config.AuthConfig.AuthPath, redirect)
-		}
-		return c.Render(http.StatusOK, "AuthTemplate", struct {
-			Path string
-		}{
-			Path: path,
+// safeRedirect only lets through paths on the same host, so that the login
+// cannot be used to redirect to other sites. Anything else redirects to /.
+func safeRedirect(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.ContainsAny(uri, "\\\r\n\t") {
+		return "/"
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return uri
+}
+
+// loginPath is the login page that redirects to redirectUri after the login.
+func loginPath(authPath, redirectUri string) string {
+	if redirectUri == "" {
+		return authPath
+	}
+	return authPath + "?" + url.Values{"redirect_uri": {safeRedirect(redirectUri)}}.Encode()
+}
+
+func sameSiteMode(s string) http.SameSite {
+	switch s {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// cookieSecure tells whether cookies set in response to the request are
+// marked Secure.
+func (a *Auth) cookieSecure(c echo.Context) bool {
+	config := a.getConfig()
+	if config.CookieSecure == "auto" {
+		return c.Scheme() == "https"
+	}
+	return config.CookieSecure == "true"
+}
+
+func (a *Auth) newCookie(c echo.Context, name, path, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Path:     path,
+		Value:    value,
+		HttpOnly: true,
+		Secure:   a.cookieSecure(c),
+		SameSite: sameSiteMode(a.getConfig().CookieSameSite),
+	}
+}
+
+func (a *Auth) setAuthCookie(c echo.Context, token string) {
+	c.SetCookie(a.newCookie(c, authCookieName, "/", token))
+}
+
+func (a *Auth) clearAuthCookie(c echo.Context) {
+	cookie := a.newCookie(c, authCookieName, "/", "")
+	cookie.MaxAge = -1
+	c.SetCookie(cookie)
+}
+
+// CSRF protects the forms of the launcher's pages under path with a token in
+// a cookie that must be sent back in the csrf_token form field. The cookie is
+// marked Secure like the others, which may depend on the request.
+func (a *Auth) CSRF(path string) echo.MiddlewareFunc {
+	config := a.getConfig()
+	csrf := func(secure bool) echo.MiddlewareFunc {
+		return middleware.CSRFWithConfig(middleware.CSRFConfig{
+			TokenLookup:    "form:csrf_token",
+			CookieName:     csrfCookieName,
+			CookiePath:     path,
+			CookieHTTPOnly: true,
+			CookieSecure:   secure,
+			CookieSameSite: sameSiteMode(config.CookieSameSite),
 		})
 	}
+	plain, secure := csrf(false), csrf(true)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		plainNext, secureNext := plain(next), secure(next)
+		return func(c echo.Context) error {
+			if a.cookieSecure(c) {
+				return secureNext(c)
+			}
+			return plainNext(c)
+		}
+	}
+}
+
+// Session is what a token stands for. Token services keep it, or carry it in
+// the token, so that the user is known on every request.
+type Session struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	ClientIp  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+func newSession(c echo.Context, token, username string, now time.Time) *Session {
+	s := &Session{
+		Id:       tokenKey(token),
+		Username: username,
+		Created:  now,
+	}
+	s.touch(c, now)
+	return s
+}
+
+// stale reports whether the session is due to be extended. Stores only write
+// sessions back once half of their lifetime has passed, rather than on every
+// request, so LastSeen is only accurate to that.
+func (s *Session) stale(now time.Time) bool {
+	return s.Expires.Sub(now) < tokenTtl/2 && s.Expires.Before(s.maxExpires())
 }
 
+// maxExpires is when the session ends however active its user is, so that
+// stolen tokens cannot be kept alive forever.
+func (s *Session) maxExpires() time.Time {
+	return s.Created.Add(sessionMaxAge)
+}
+
+// extend moves the expiry of the session to tokenTtl from now, but not past
+// maxExpires.
+func (s *Session) extend(now time.Time) {
+	s.Expires = now.Add(tokenTtl)
+	if max := s.maxExpires(); s.Expires.After(max) {
+		s.Expires = max
+	}
+}
+
+// touch extends the session on a request from its user.
+func (s *Session) touch(c echo.Context, now time.Time) {
+	s.LastSeen = now
+	s.extend(now)
+	s.ClientIp = c.RealIP()
+	s.UserAgent = c.Request().UserAgent()
+}
+
+var errSessionsUnsupported = errors.New("sessions are not kept by the token store")
+
 type TokenService interface {
-	NewToken(c echo.Context) (string, error)
-	Verify(c echo.Context, token string) (bool, error)
+	NewToken(c echo.Context, username string) (string, error)
+	// Verify returns the session of a valid token and extends it, or nil if
+	// the token is unknown or expired.
+	Verify(c echo.Context, token string) (*Session, error)
+	// Revoke ends the session of a token, as on logout.
+	Revoke(c echo.Context, token string) error
+	// Sessions lists the sessions that have not expired.
+	Sessions(c echo.Context) ([]*Session, error)
+	// RevokeSessions ends the sessions that match and returns their number.
+	RevokeSessions(c echo.Context, match func(s *Session) bool) (int, error)
+}
+
+type TokenCleaner interface {
+	Cleanup() error
 }
 
 type MemTokenService struct {
 	mu    sync.Mutex
-	store map[string]time.Time
+	store map[string]*Session
 	Clock func() time.Time
 }
 
@@ -51,132 +218,524 @@ func NewMemTokenService() *MemTokenService {
 	}
 
 	return &MemTokenService{
-		store: make(map[string]time.Time),
+		store: make(map[string]*Session),
 		Clock: clock,
 	}
 }
 
-func (mts *MemTokenService) NewToken(c echo.Context) (string, error) {
-	tokenLen := 32
-
-	token := make([]byte, tokenLen)
-	_, err := rand.Read(token)
+func (mts *MemTokenService) NewToken(c echo.Context, username string) (string, error) {
+	tokenStr, err := newTokenString()
 	if err != nil {
 		return "", err
 	}
 
-	tokenStr := base64.RawURLEncoding.EncodeToString(token)
-
 	mts.mu.Lock()
 	defer mts.mu.Unlock()
 
-	mts.store[tokenStr] = mts.Clock().Add(tokenTtl)
+	mts.store[tokenStr] = newSession(c, tokenStr, username, mts.Clock())
 	return tokenStr, nil
 }
 
-func (mts *MemTokenService) Verify(c echo.Context, token string) (bool, error) {
+func (mts *MemTokenService) Verify(c echo.Context, token string) (*Session, error) {
 	mts.mu.Lock()
 	defer mts.mu.Unlock()
 
-	exp, ok := mts.store[token]
+	sess, ok := mts.store[token]
 
 	if !ok {
-		c.Logger().Debugf("Token %v is not found", token)
-		return false, nil
+		c.Logger().Debug("Token is not found")
+		return nil, nil
 	}
 
-	if mts.Clock().After(exp) {
-		c.Logger().Debugf("Token %v is not expired after %v", token, exp)
+	if mts.Clock().After(sess.Expires) {
+		c.Logger().Debugf("Token is expired after %v", sess.Expires)
 		delete(mts.store, token)
-		return false, nil
+		return nil, nil
 	}
 
-	mts.store[token] = mts.Clock().Add(tokenTtl)
-	return true, nil
+	sess.touch(c, mts.Clock())
+	copied := *sess
+	return &copied, nil
+}
+
+func (mts *MemTokenService) Revoke(c echo.Context, token string) error {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+
+	delete(mts.store, token)
+	return nil
+}
+
+func (mts *MemTokenService) Sessions(c echo.Context) ([]*Session, error) {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+
+	now := mts.Clock()
+	var sessions []*Session
+	for _, sess := range mts.store {
+		if !now.After(sess.Expires) {
+			copied := *sess
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions, nil
+}
+
+func (mts *MemTokenService) RevokeSessions(c echo.Context, match func(s *Session) bool) (int, error) {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+
+	n := 0
+	for token, sess := range mts.store {
+		if match(sess) {
+			delete(mts.store, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (mts *MemTokenService) Cleanup() error {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+
+	now := mts.Clock()
+	for token, sess := range mts.store {
+		if now.After(sess.Expires) {
+			delete(mts.store, token)
+		}
+	}
+	return nil
 }
 
 type Auth struct {
 	tokens TokenService
+
+	mu     sync.RWMutex
 	config *AuthConfig
+	users  *Users
+	oidc   *OidcProvider
+	api    *ApiTokens
+
+	trusted []*net.IPNet
+	limiter *LoginLimiter
+	basic   *BasicCache
 }
 
-func NewAuthFromConfig(config *Config) *Auth {
-	return &Auth{
-		tokens: NewMemTokenService(),
-		config: &config.AuthConfig,
+func NewAuthFromConfig(config *Config) (*Auth, error) {
+	tokens, err := NewTokenServiceFromConfig(&config.AuthConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Auth{
+		tokens:  tokens,
+		config:  &config.AuthConfig,
+		limiter: NewLoginLimiter(),
+		basic:   NewBasicCache(),
+	}
+
+	if sts, ok := tokens.(*SignedTokenService); ok {
+		sts.OnRefresh = a.setAuthCookie
+	}
+
+	if config.AuthConfig.UsersFile != "" {
+		a.users, err = LoadUsersFile(config.AuthConfig.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuthConfig.ApiTokensFile != "" {
+		a.api, err = LoadApiTokensFile(config.AuthConfig.ApiTokensFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuthConfig.Mode == AuthModeOidc {
+		a.oidc = NewOidcProvider(&config.AuthConfig.OidcConfig)
 	}
+
+	a.trusted, err = parseCidrs(config.AuthConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
 }
 
-func (a *Auth) redirectToLoginPage(c echo.Context) error {
-	redirectUri := c.Request().URL.Path
-	if redirectUri != "" && !strings.HasPrefix(redirectUri, "/") {
-		redirectUri = "/" + redirectUri
+// Start removes expired tokens in the background for token services that do
+// not expire them on their own.
+func (a *Auth) Start(c echo.Context) {
+	tc, ok := a.tokens.(TokenCleaner)
+	if !ok {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(a.getConfig().TokenCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := tc.Cleanup(); err != nil {
+				c.Logger().Errorf("Failed to clean up expired tokens: %v", err)
+			}
+		}
+	}()
+}
+
+// Reload applies new credentials, and reads the users and api tokens files
+// again. Sessions are kept, and the auth path and mode stay the same because
+// their routes are registered on startup.
+func (a *Auth) Reload(c echo.Context, config *Config) {
+	var users *Users
+	if config.AuthConfig.UsersFile != "" {
+		var err error
+		users, err = LoadUsersFile(config.AuthConfig.UsersFile)
+		if err != nil {
+			c.Logger().Errorf("Failed to reload users, keeping the current ones: %v", err)
+			users = a.getUsers()
+		}
+	}
+
+	var api *ApiTokens
+	if config.AuthConfig.ApiTokensFile != "" {
+		var err error
+		api, err = LoadApiTokensFile(config.AuthConfig.ApiTokensFile)
+		if err != nil {
+			c.Logger().Errorf("Failed to reload api tokens, keeping the current ones: %v", err)
+			api = a.getApiTokens()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ac := config.AuthConfig
+	ac.AuthPath = a.config.AuthPath
+	ac.Mode = a.config.Mode
+	ac.CookieSecure = a.config.CookieSecure
+	ac.CookieSameSite = a.config.CookieSameSite
+
+	if a.oidc != nil && !reflect.DeepEqual(ac.OidcConfig, a.config.OidcConfig) {
+		a.oidc = NewOidcProvider(&ac.OidcConfig)
+	}
+
+	a.config = &ac
+	a.users = users
+	a.api = api
+	a.basic.Clear()
+}
+
+func (a *Auth) getApiTokens() *ApiTokens {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.api
+}
+
+func (a *Auth) getOidc() *OidcProvider {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.oidc
+}
+
+func (a *Auth) getUsers() *Users {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.users
+}
+
+func (a *Auth) checkPassword(username, password string) bool {
+	config, users := a.getConfig(), a.getUsers()
+
+	ok := false
+	if users != nil && users.Check(username, password) {
+		ok = true
 	}
-	t := a.config.AuthPath
-	if redirectUri != "" {
-		t += "?redirect_uri=" + redirectUri
+	if config.Username != "" {
+		userOk := secureEqual(strings.ToLower(username), strings.ToLower(config.Username))
+		passOk := secureEqual(password, config.Password)
+		ok = ok || userOk && passOk
 	}
+	return ok
+}
+
+func (a *Auth) getConfig() *AuthConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.config
+}
+
+// acceptsHtml tells browsers, which are sent to the login page, from other
+// clients.
+func acceptsHtml(req *http.Request) bool {
+	accept := req.Header.Get(echo.HeaderAccept)
+	return strings.Contains(accept, echo.MIMETextHTML) || strings.Contains(accept, "application/xhtml+xml")
+}
+
+func (a *Auth) unauthorized(c echo.Context) error {
+	challenge := "Bearer"
+	if a.getConfig().BasicAuth {
+		challenge = `Basic realm="launcher", charset="UTF-8", ` + challenge
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, challenge)
+	return echo.ErrUnauthorized
+}
+
+func (a *Auth) redirectToLoginPage(c echo.Context) error {
+	t := loginPath(a.getConfig().AuthPath, c.Request().URL.RequestURI())
 	return c.Redirect(http.StatusTemporaryRedirect, t)
 }
 
+// IPExtractor gets the client IP from X-Forwarded-For, but only from the
+// trusted proxies.
+func (a *Auth) IPExtractor() echo.IPExtractor {
+	if len(a.trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range a.trusted {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+func (a *Auth) fromTrustedProxy(c echo.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range a.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorization checks an API token or, if enabled, basic auth credentials in
+// the Authorization header. The header is removed once used, so that it is
+// not passed on to the instance.
+func (a *Auth) authorization(c echo.Context, config *AuthConfig) *Session {
+	req := c.Request()
+	scheme, credentials, _ := strings.Cut(req.Header.Get(echo.HeaderAuthorization), " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		api := a.getApiTokens()
+		if api == nil {
+			return nil
+		}
+		t, ok := api.Lookup(credentials)
+		if !ok {
+			c.Logger().Debug("Api token is not found")
+			return nil
+		}
+		req.Header.Del(echo.HeaderAuthorization)
+		c.Set("ApiToken", t.Name)
+		c.Set("AuthMethod", authMethodApi)
+		return &Session{Username: t.Username}
+	case strings.EqualFold(scheme, "Basic") && config.BasicAuth:
+		username, password, ok := req.BasicAuth()
+		if !ok {
+			return nil
+		}
+		keys := loginKeys(c, username)
+		if wait := a.limiter.Locked(config, keys...); wait > 0 {
+			c.Logger().Warnf("Rejected basic auth as %v from %v, locked out for %v", username, c.RealIP(), wait.Round(time.Second))
+			return nil
+		}
+		header := req.Header.Get(echo.HeaderAuthorization)
+		if !a.basic.Accepted(header) {
+			if !a.checkPassword(username, password) {
+				c.Logger().Warnf("Failed basic auth as %v from %v", username, c.RealIP())
+				a.limiter.Fail(c, config, keys...)
+				return nil
+			}
+			a.limiter.Reset(keys[1:]...)
+			a.basic.Add(header)
+		}
+		req.Header.Del(echo.HeaderAuthorization)
+		c.Set("AuthMethod", authMethodBasic)
+		return &Session{Username: username}
+	}
+
+	return nil
+}
+
+// session finds the session of the request, from an API token or basic auth,
+// or from the user header set by a trusted proxy in header mode, or from the
+// session cookie otherwise.
+func (a *Auth) session(c echo.Context) (*Session, error) {
+	config := a.getConfig()
+
+	if sess := a.authorization(c, config); sess != nil {
+		return sess, nil
+	}
+
+	if config.Mode == AuthModeHeader {
+		username := c.Request().Header.Get(config.UserHeader)
+		if username == "" {
+			c.Logger().Debugf("Header %s is not found", config.UserHeader)
+			return nil, nil
+		}
+		if !a.fromTrustedProxy(c) {
+			c.Logger().Warnf("Ignoring header %s from untrusted address %s", config.UserHeader, c.Request().RemoteAddr)
+			return nil, nil
+		}
+		c.Set("AuthMethod", authMethodHeader)
+		return &Session{Username: username}, nil
+	}
+
+	cookie, err := c.Cookie(authCookieName)
+	if err != nil {
+		if errors.Is(err, http.ErrNoCookie) {
+			c.Logger().Debug("Cookie is not found")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	c.Set("AuthMethod", authMethodCookie)
+	return a.tokens.Verify(c, cookie.Value)
+}
+
+// passwordLogin reports whether the user of the request gave a password, with
+// basic auth or on the login form, rather than being vouched for by an oidc
+// provider or a proxy.
+func passwordLogin(c echo.Context, config *AuthConfig) bool {
+	switch c.Get("AuthMethod") {
+	case authMethodBasic:
+		return true
+	case authMethodCookie:
+		return config.Mode == AuthModeForm
+	}
+	return false
+}
+
 func (a *Auth) Authenticate() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			cookie, err := c.Cookie(authCookieName)
-			if err != nil {
-				if errors.Is(err, http.ErrNoCookie) {
-					c.Logger().Debug("Cookie is not found")
-					return a.redirectToLoginPage(c)
-				}
-				return err
-			}
-
-			ok, err := a.tokens.Verify(c, cookie.Value)
+			sess, err := a.session(c)
 			if err != nil {
 				return err
 			}
 
-			if !ok {
+			if sess == nil {
+				if a.getConfig().Mode == AuthModeHeader || !acceptsHtml(c.Request()) {
+					return a.unauthorized(c)
+				}
 				return a.redirectToLoginPage(c)
 			}
 
+			c.Set("Username", sess.Username)
+			c.Set("Role", a.Role(sess.Username, passwordLogin(c, a.getConfig())))
+			c.Set("Session", sess)
 			return next(c)
 		}
 	}
 }
 
+// Verify is an endpoint for the forward_auth of Caddy and Traefik, or the
+// auth_request of nginx, so that other services can be protected by the
+// launcher's login. It answers 200 with the username in the Remote-User
+// header for logged in users. Others are redirected to the login page if the
+// proxy tells the original URI in X-Forwarded-Uri, or get a 401 otherwise.
+func (a *Auth) Verify() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sess, err := a.session(c)
+		if err != nil {
+			return err
+		}
+
+		if sess != nil {
+			c.Response().Header().Set("Remote-User", sess.Username)
+			c.Response().Header().Set(a.getConfig().UserHeader, sess.Username)
+			return c.NoContent(http.StatusOK)
+		}
+
+		req := c.Request()
+		uri := req.Header.Get("X-Forwarded-Uri")
+		if uri == "" || a.getConfig().Mode == AuthModeHeader {
+			return echo.ErrUnauthorized
+		}
+
+		proto := req.Header.Get(echo.HeaderXForwardedProto)
+		if proto == "" {
+			proto = "https"
+		}
+		host := req.Header.Get("X-Forwarded-Host")
+		if host == "" {
+			host = req.Host
+		}
+
+		// The login page is served on the host of the protected service, so
+		// the proxy must route the auth path of that host to the launcher too.
+		target := url.URL{
+			Scheme:   proto,
+			Host:     host,
+			Path:     a.getConfig().AuthPath,
+			RawQuery: url.Values{"redirect_uri": {safeRedirect(uri)}}.Encode(),
+		}
+		return c.Redirect(http.StatusFound, target.String())
+	}
+}
+
 func (a *Auth) Login() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		username := c.FormValue("username")
 		password := c.FormValue("password")
 		redirectUri := c.QueryParam("redirect_uri")
 
-		if username != a.config.Username || password != a.config.Password {
-			path := a.config.AuthPath
-			if redirectUri != "" {
-				path += "?redirect_uri=" + redirectUri
-			}
-			return c.Render(http.StatusUnauthorized, "AuthTemplate", struct {
-				Path string
-			}{
-				Path: path,
+		config := a.getConfig()
+		path := loginPath(config.AuthPath, redirectUri)
+		csrf, _ := c.Get("csrf").(string)
+
+		keys := loginKeys(c, username)
+		if wait := a.limiter.Locked(config, keys...); wait > 0 {
+			wait = (wait + time.Second - 1).Truncate(time.Second)
+			c.Logger().Warnf("Rejected login as %v from %v, locked out for %v", username, c.RealIP(), wait)
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())))
+			return c.Render(http.StatusTooManyRequests, "AuthTemplate", LoginPageParams{
+				Path:  path,
+				Csrf:  csrf,
+				Error: fmt.Sprintf("Too many failed logins, try again in %v.", wait),
+			})
+		}
+
+		if !a.checkPassword(username, password) {
+			c.Logger().Warnf("Failed login as %v from %v", username, c.RealIP())
+			a.limiter.Fail(c, config, keys...)
+			return c.Render(http.StatusUnauthorized, "AuthTemplate", LoginPageParams{
+				Path:  path,
+				Csrf:  csrf,
+				Error: "Wrong username or password.",
 			})
 		}
+		// Only the username is reset, so that a valid login does not let an
+		// IP guess the passwords of others.
+		a.limiter.Reset(keys[1:]...)
 
 		c.Logger().Infof("Logged in as %v", username)
 
 		c.Set("Username", username)
-		token, err := a.tokens.NewToken(c)
+		token, err := a.tokens.NewToken(c, username)
 		if err != nil {
 			return err
 		}
 
-		c.SetCookie(&http.Cookie{
-			Name:     authCookieName,
-			Path:     "/",
-			Value:    token,
-			HttpOnly: true,
-		})
-		return c.Redirect(http.StatusFound, redirectUri)
+		a.setAuthCookie(c, token)
+		return c.Redirect(http.StatusFound, safeRedirect(redirectUri))
 	}
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// loadTestConfig loads a config file with an exec app and the given auth
+// section, which is indented by two spaces.
+func loadTestConfig(t *testing.T, auth string) *Config {
+	t.Helper()
+	content := "backend: exec\nexec:\n  command: true\n  port: 9\nauth:\n" + auth
+	path := filepath.Join(t.TempDir(), "launcher.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+func newTestAuth(t *testing.T, auth string) (*Auth, *Config) {
+	t.Helper()
+	config := loadTestConfig(t, auth)
+	a, err := NewAuthFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, config
+}
+
+func TestAuthorization(t *testing.T) {
+	token, line, err := NewApiToken("ci", "robot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokensFile := filepath.Join(t.TempDir(), "api-tokens.txt")
+	if err := os.WriteFile(tokensFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		basic    bool
+		header   string
+		username string
+	}{
+		{"api token", false, "Bearer " + token, "robot"},
+		{"api token scheme case", false, "bearer " + token, "robot"},
+		{"unknown api token", false, "Bearer " + apiTokenPrefix + "other", ""},
+		{"basic auth", true, basicHeader("esh", "hunter2secret"), "esh"},
+		{"basic auth username case", true, basicHeader("ESH", "hunter2secret"), "ESH"},
+		{"basic auth wrong password", true, basicHeader("esh", "hunter3secret"), ""},
+		{"basic auth disabled", false, basicHeader("esh", "hunter2secret"), ""},
+		{"malformed basic auth", true, "Basic !!!", ""},
+		{"other scheme", true, "Digest username=esh", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, config := newTestAuth(t, fmt.Sprintf("  enable: true\n  username: esh\n  password: hunter2secret\n  basic: %v\n  api_tokens_file: %s\n", tt.basic, tokensFile))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, tt.header)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			sess := a.authorization(c, &config.AuthConfig)
+
+			if tt.username == "" {
+				if sess != nil {
+					t.Fatalf("got session of %q, want none", sess.Username)
+				}
+				return
+			}
+			if sess == nil || sess.Username != tt.username {
+				t.Fatalf("got session %v, want one of %q", sess, tt.username)
+			}
+			if req.Header.Get(echo.HeaderAuthorization) != "" {
+				t.Fatal("authorization header is passed on")
+			}
+		})
+	}
+}
+
+func basicHeader(username, password string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(username, password)
+	return req.Header.Get(echo.HeaderAuthorization)
+}
+
+func TestBasicAuthCache(t *testing.T) {
+	a, config := newTestAuth(t, "  enable: true\n  username: esh\n  password: hunter2secret\n  basic: true\n")
+	now := time.Now()
+	a.basic.Clock = func() time.Time { return now }
+
+	check := func(header string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderAuthorization, header)
+		return a.authorization(echo.New().NewContext(req, httptest.NewRecorder()), a.getConfig()) != nil
+	}
+	header := basicHeader("esh", "hunter2secret")
+	if !check(header) {
+		t.Fatal("basic auth was rejected")
+	}
+
+	// Changed behind the cache's back, the password is not checked again
+	// until the cached credentials expire.
+	changed := *a.getConfig()
+	changed.Password = "other-password"
+	a.config = &changed
+	if !check(header) {
+		t.Fatal("cached basic auth was rejected")
+	}
+	if check(basicHeader("esh", "hunter3secret")) {
+		t.Fatal("wrong password was accepted")
+	}
+	now = now.Add(basicCacheTtl)
+	if check(header) {
+		t.Fatal("expired basic auth was accepted")
+	}
+
+	a.config = &config.AuthConfig
+	if !check(header) {
+		t.Fatal("basic auth was rejected")
+	}
+	reloaded := *config
+	reloaded.AuthConfig.Password = "other-password"
+	a.Reload(testContext(), &reloaded)
+	if check(header) {
+		t.Fatal("basic auth was accepted with the old password after a reload")
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"/app", "/app"},
+		{"/app/?a=1&b=2#top", "/app/?a=1&b=2#top"},
+		{"/", "/"},
+		{"", "/"},
+		{"app", "/"},
+		{"//evil.example.com", "/"},
+		{"//evil.example.com/app", "/"},
+		{"/\\evil.example.com", "/"},
+		{"\\\\evil.example.com", "/"},
+		{"/\t/evil.example.com", "/"},
+		{"https://evil.example.com", "/"},
+		{"javascript:alert(1)", "/"},
+		{"data:text/html,x", "/"},
+		{"/app\r\nSet-Cookie: x=1", "/"},
+		{"/app\nLocation: //evil", "/"},
+		{"/%2F/evil.example.com", "/%2F/evil.example.com"},
+		{"/app%0d%0a", "/app%0d%0a"},
+	}
+	for _, tt := range tests {
+		if got := safeRedirect(tt.uri); got != tt.want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFCookieSecure(t *testing.T) {
+	tests := []struct {
+		setting string
+		proto   string
+		secure  bool
+	}{
+		{"auto", "http", false},
+		{"auto", "https", true},
+		{"true", "http", true},
+		{"false", "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting+"/"+tt.proto, func(t *testing.T) {
+			a, _ := newTestAuth(t, "  enable: true\n  username: esh\n  password: hunter2secret\n  cookie_secure: \""+tt.setting+"\"\n")
+			h := a.CSRF("/.launcher/auth")(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/.launcher/auth", nil)
+			req.Header.Set(echo.HeaderXForwardedProto, tt.proto)
+			rec := httptest.NewRecorder()
+			if err := h(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+				t.Fatalf("got cookies %v, want the csrf cookie", cookies)
+			}
+			if cookies[0].Secure != tt.secure {
+				t.Fatalf("got Secure %v, want %v", cookies[0].Secure, tt.secure)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	basicCacheTtl  = time.Minute
+	basicCacheSize = 1024
+)
+
+// BasicCache remembers basic auth credentials that were accepted, by a digest
+// of the Authorization header, so that scripts and clients that send them
+// with every request do not cost a bcrypt or argon2 check each time. It is
+// cleared when the users change.
+type BasicCache struct {
+	mu       sync.Mutex
+	accepted map[string]time.Time
+	Clock    func() time.Time
+}
+
+func NewBasicCache() *BasicCache {
+	clock := func() time.Time {
+		return time.Now()
+	}
+
+	return &BasicCache{
+		accepted: make(map[string]time.Time),
+		Clock:    clock,
+	}
+}
+
+// Accepted reports whether the header was accepted less than basicCacheTtl
+// ago.
+func (bc *BasicCache) Accepted(header string) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	expires, ok := bc.accepted[tokenKey(header)]
+	return ok && bc.Clock().Before(expires)
+}
+
+func (bc *BasicCache) Add(header string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	now := bc.Clock()
+	if len(bc.accepted) >= basicCacheSize {
+		for key, expires := range bc.accepted {
+			if !now.Before(expires) {
+				delete(bc.accepted, key)
+			}
+		}
+	}
+	if len(bc.accepted) >= basicCacheSize {
+		bc.accepted = make(map[string]time.Time)
+	}
+	bc.accepted[tokenKey(header)] = now.Add(basicCacheTtl)
+}
+
+func (bc *BasicCache) Clear() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.accepted = make(map[string]time.Time)
+}
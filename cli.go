@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
+	"golang.org/x/term"
+)
+
+// commandFlags are the options shared by the commands that use the config.
+type commandFlags struct {
+	*flag.FlagSet
+	config string
+	json   bool
+	app    string
+}
+
+func newCommandFlags(name, doc string, withApp bool) *commandFlags {
+	f := &commandFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.StringVar(&f.config, "config", os.Getenv("CONFIG_FILE"), "config file")
+	f.BoolVar(&f.json, "json", false, "print JSON")
+	if withApp {
+		f.StringVar(&f.app, "app", "", "name of the app")
+	}
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "Usage: launcher %s [OPTIONS]\n%s\n", name, doc)
+		f.PrintDefaults()
+	}
+	return f
+}
+
+func (f *commandFlags) parse(args []string) {
+	f.Parse(args)
+	if f.NArg() != 0 {
+		f.Usage()
+		os.Exit(2)
+	}
+}
+
+// commandContext is the context for the instance clients in commands. Their
+// logs go to stderr, so that the output can be piped. It has a request, as
+// the clients read the client IP and user agent of the request in places.
+func commandContext(config *Config) echo.Context {
+	e := echo.New()
+	logger := NewLogger(config.LogFormat)
+	logger.SetSecrets(configSecrets(config))
+	logger.SetOutput(os.Stderr)
+	e.Logger = logger
+	if config.LogLevel == "DEBUG" {
+		setLogLevel(e.Logger, config.LogLevel)
+	} else {
+		e.Logger.SetLevel(elog.WARN)
+	}
+	return e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+}
+
+func printJson(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// commandApps picks the app named by -app, all apps if all is set, or the
+// only app otherwise.
+func commandApps(router *Router, name string, all bool) ([]*App, error) {
+	if name != "" {
+		app := router.App(name)
+		if app == nil {
+			return nil, fmt.Errorf("unknown app %s", name)
+		}
+		return []*App{app}, nil
+	}
+
+	apps := router.Apps()
+	if len(apps) > 1 && !all {
+		return nil, errors.New("there are several apps, pick one with -app")
+	}
+	return apps, nil
+}
+
+var errExecCommand = errors.New("the processes of the exec backend are only managed by launcher serve")
+
+type commandStatus struct {
+	Name        string `json:"name"`
+	Backend     string `json:"backend"`
+	Running     bool   `json:"running"`
+	Url         string `json:"url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func appCommandStatus(c echo.Context, app *App) commandStatus {
+	s := app.Launcher.current()
+	cs := commandStatus{
+		Name:    app.Name,
+		Backend: s.config.Backend,
+	}
+
+	if s.config.Backend == BackendExec {
+		cs.Error = errExecCommand.Error()
+		return cs
+	}
+
+	status, err := app.Launcher.Status(c)
+	if err != nil {
+		cs.Error = err.Error()
+		return cs
+	}
+
+	cs.Running = status.Running
+	cs.Url = status.Url
+	cs.Description = status.Description
+	return cs
+}
+
+func printStatuses(f *commandFlags, statuses []commandStatus) error {
+	if f.json {
+		return printJson(statuses)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBACKEND\tSTATE\tURL\tDESCRIPTION")
+	for _, s := range statuses {
+		state := "not running"
+		switch {
+		case s.Error != "":
+			state = "unknown"
+		case s.Running:
+			state = "running"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.Backend, state, s.Url, s.Description)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		if s.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s.Name, s.Error)
+		}
+	}
+	return nil
+}
+
+func statusCommand(args []string) error {
+	f := newCommandFlags("status", "Shows whether the instances of the apps are running, without launching them.", true)
+	f.parse(args)
+
+	config, err := LoadConfig(f.config)
+	if err != nil {
+		return err
+	}
+	c := commandContext(&config)
+
+	apps, err := commandApps(NewRouterFromConfig(&config), f.app, true)
+	if err != nil {
+		return err
+	}
+
+	var (
+		statuses []commandStatus
+		failed   bool
+	)
+	for _, app := range apps {
+		status := appCommandStatus(c, app)
+		statuses = append(statuses, status)
+		failed = failed || status.Error != ""
+	}
+
+	if err := printStatuses(f, statuses); err != nil {
+		return err
+	}
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func launchCommand(args []string) error {
+	f := newCommandFlags("launch", "Launches the instance of an app unless it is running.", true)
+	force := f.Bool("force", false, "launch even if the app is only shut down when idle by launcher serve")
+	timeout := f.Duration("timeout", 10*time.Minute, "how long to wait for an instance that is starting")
+	f.parse(args)
+
+	config, err := LoadConfig(f.config)
+	if err != nil {
+		return err
+	}
+	c := commandContext(&config)
+
+	apps, err := commandApps(NewRouterFromConfig(&config), f.app, false)
+	if err != nil {
+		return err
+	}
+	app := apps[0]
+	if app.Launcher.current().config.Backend == BackendExec {
+		return errExecCommand
+	}
+	// The idle alarm runs in launcher serve, which only watches instances it
+	// launches, finds on startup or serves a request to.
+	if app.Launcher.current().config.Alarm == AlarmIdle {
+		if !*force {
+			return fmt.Errorf("app %s is shut down when idle by launcher serve, which does not know of instances launched here until it serves a request to them, so the instance may run until it is stopped by hand; use -force to launch it anyway", app.Name)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: the instance of app %s is not shut down when idle until launcher serve serves a request to it or restarts\n", app.Name)
+	}
+
+	// An instance that is still stopping is started in the background once it
+	// has stopped, which needs this process to keep running.
+	deadline := time.Now().Add(*timeout)
+	for {
+		_, _, err = app.Launcher.LaunchInstance(c)
+		if !errors.Is(err, errPending) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the instance of app %s is still starting after %v", app.Name, *timeout)
+		}
+		time.Sleep(startingRefreshSeconds * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	return printStatuses(f, []commandStatus{appCommandStatus(c, app)})
+}
+
+func shutdownCommand(name, action string, args []string) error {
+	f := newCommandFlags(name, fmt.Sprintf("Makes the instance of an app %s.", action), true)
+	f.parse(args)
+
+	config, err := LoadConfig(f.config)
+	if err != nil {
+		return err
+	}
+	c := commandContext(&config)
+
+	apps, err := commandApps(NewRouterFromConfig(&config), f.app, false)
+	if err != nil {
+		return err
+	}
+	app := apps[0]
+	if app.Launcher.current().config.Backend == BackendExec {
+		return errExecCommand
+	}
+
+	err = app.Launcher.Shutdown(c, action)
+	if errors.Is(err, errNotFound) {
+		return fmt.Errorf("no instance of app %s is running", app.Name)
+	}
+	if err != nil {
+		return err
+	}
+	return printStatuses(f, []commandStatus{appCommandStatus(c, app)})
+}
+
+func validateConfigCommand(args []string) error {
+	f := newCommandFlags("validate-config", "Checks the config and reports every problem it finds.", false)
+	f.parse(args)
+
+	result := struct {
+		Valid  bool     `json:"valid"`
+		Apps   []string `json:"apps,omitempty"`
+		Errors []string `json:"errors,omitempty"`
+	}{}
+
+	config, err := LoadConfig(f.config)
+	var errs ConfigErrors
+	switch {
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			result.Errors = append(result.Errors, e.Error())
+		}
+	case err != nil:
+		result.Errors = []string{err.Error()}
+	default:
+		result.Valid = true
+		for _, ac := range config.Apps {
+			result.Apps = append(result.Apps, ac.Name)
+		}
+	}
+
+	if f.json {
+		if err := printJson(result); err != nil {
+			return err
+		}
+	} else if result.Valid {
+		fmt.Printf("Config is valid, apps: %s\n", strings.Join(result.Apps, ", "))
+	} else {
+		fmt.Println("Config is invalid:")
+		for _, e := range result.Errors {
+			fmt.Printf("  %s\n", e)
+		}
+	}
+
+	if !result.Valid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func cleanupCommand(args []string) error {
+	f := newCommandFlags("cleanup", "Removes expired sessions from the token store.", false)
+	f.parse(args)
+
+	config, err := LoadConfig(f.config)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		TokenStore string `json:"token_store,omitempty"`
+		Cleaned    bool   `json:"cleaned"`
+	}{}
+
+	var msg string
+	switch {
+	case !config.AuthConfig.EnableAuth:
+		msg = "Auth is disabled, there are no sessions"
+	case config.AuthConfig.TokenStore != TokenStoreBolt:
+		result.TokenStore = config.AuthConfig.TokenStore
+		msg = fmt.Sprintf("The %s token store needs no cleanup", result.TokenStore)
+	default:
+		result.TokenStore = config.AuthConfig.TokenStore
+		tokens, err := NewTokenServiceFromConfig(&config.AuthConfig)
+		if err != nil {
+			return fmt.Errorf("%w, a running launcher cleans up by itself", err)
+		}
+		if closer, ok := tokens.(io.Closer); ok {
+			defer closer.Close()
+		}
+		if err := tokens.(TokenCleaner).Cleanup(); err != nil {
+			return err
+		}
+		result.Cleaned = true
+		msg = "Removed expired sessions from " + config.AuthConfig.TokenFile
+	}
+
+	if f.json {
+		return printJson(result)
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func hashPasswordCommand(args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	useArgon2 := fs.Bool("argon2", false, "hash with argon2id instead of bcrypt")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: launcher hash-password [-argon2] USERNAME")
+		fmt.Fprintln(fs.Output(), "Reads the password from the terminal or stdin and prints a users file entry.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	username := fs.Arg(0)
+	if strings.Contains(username, ":") {
+		return errors.New("username must not contain ':'")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+
+	hash, err := HashPassword(password, *useArgon2)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s:%s\n", username, hash)
+	return nil
+}
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(confirm) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func apiTokenCommand(args []string) error {
+	fs := flag.NewFlagSet("api-token", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: launcher api-token NAME USERNAME")
+		fmt.Fprintln(fs.Output(), "Prints an api tokens file entry, and the token itself to stderr.")
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	token, line, err := NewApiToken(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(line)
+	fmt.Fprintf(os.Stderr, "Token, which is not stored anywhere: %s\n", token)
+	return nil
+}
@@ -1,42 +1,224 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	env "github.com/caarlos0/env/v8"
+	"gopkg.in/yaml.v3"
+)
+
+type OidcConfig struct {
+	Issuer       string   `env:"AUTH_OIDC_ISSUER" yaml:"issuer"`
+	ClientId     string   `env:"AUTH_OIDC_CLIENT_ID" yaml:"client_id"`
+	ClientSecret string   `env:"AUTH_OIDC_CLIENT_SECRET" yaml:"client_secret" redact:"true"`
+	RedirectUrl  string   `env:"AUTH_OIDC_REDIRECT_URL" yaml:"redirect_url"`
+	Scopes       []string `env:"AUTH_OIDC_SCOPES" envDefault:"openid,email,profile" yaml:"scopes"`
+	GroupsClaim  string   `env:"AUTH_OIDC_GROUPS_CLAIM" envDefault:"groups" yaml:"groups_claim"`
+
+	// Users are known by their email if it is verified and by their subject
+	// otherwise, unless another claim is set here.
+	UsernameClaim string `env:"AUTH_OIDC_USERNAME_CLAIM" yaml:"username_claim"`
+
+	// Only users with one of the allowed emails, domains or groups are let
+	// in, or anyone the provider authenticates with AllowAll.
+	AllowedEmails  []string `env:"AUTH_OIDC_ALLOWED_EMAILS" yaml:"allowed_emails"`
+	AllowedDomains []string `env:"AUTH_OIDC_ALLOWED_DOMAINS" yaml:"allowed_domains"`
+	AllowedGroups  []string `env:"AUTH_OIDC_ALLOWED_GROUPS" yaml:"allowed_groups"`
+	AllowAll       bool     `env:"AUTH_OIDC_ALLOW_ALL" envDefault:"false" yaml:"allow_all"`
+}
+
+const (
+	AuthModeForm   = "form"
+	AuthModeOidc   = "oidc"
+	AuthModeHeader = "header"
 )
 
 type AuthConfig struct {
-	AuthPath   string `env:"AUTH_PATH" envDefault:"/.launcher/auth"`
-	EnableAuth bool   `env:"ENABLE_AUTH" envDefault:"false"`
-	Username   string `env:"AUTH_USERNAME"`
-	Password   string `env:"AUTH_PASSWORD"`
+	AuthPath   string `env:"AUTH_PATH" envDefault:"/.launcher/auth" yaml:"path"`
+	EnableAuth bool   `env:"ENABLE_AUTH" envDefault:"false" yaml:"enable"`
+	Mode       string `env:"AUTH_MODE" envDefault:"form" yaml:"mode"`
+	Username   string `env:"AUTH_USERNAME" yaml:"username"`
+	Password   string `env:"AUTH_PASSWORD" yaml:"password" redact:"true"`
+	UsersFile  string `env:"AUTH_USERS_FILE" yaml:"users_file"`
+	// Users get the default role unless they are listed with another one.
+	// The user set by username is always an admin when logged in with its
+	// password. Usernames are matched regardless of case.
+	DefaultRole string   `env:"AUTH_DEFAULT_ROLE" envDefault:"operator" yaml:"default_role"`
+	Admins      []string `env:"AUTH_ADMINS" yaml:"admins"`
+	Operators   []string `env:"AUTH_OPERATORS" yaml:"operators"`
+	Viewers     []string `env:"AUTH_VIEWERS" yaml:"viewers"`
+
+	ApiTokensFile string `env:"AUTH_API_TOKENS_FILE" yaml:"api_tokens_file"`
+	BasicAuth     bool   `env:"AUTH_BASIC" envDefault:"false" yaml:"basic"`
+
+	// Logins from an IP or as a username are locked out after this many
+	// failures, for LoginLockout doubled with each further failure up to
+	// LoginMaxLockout. Failures are forgotten after LoginMaxLockout. A locked
+	// out username only applies to IPs that have failed logins too.
+	LoginMaxAttempts int           `env:"AUTH_LOGIN_MAX_ATTEMPTS" envDefault:"5" yaml:"login_max_attempts"`
+	LoginLockout     time.Duration `env:"AUTH_LOGIN_LOCKOUT" envDefault:"30s" yaml:"login_lockout"`
+	LoginMaxLockout  time.Duration `env:"AUTH_LOGIN_MAX_LOCKOUT" envDefault:"1h" yaml:"login_max_lockout"`
+
+	TokenStore           string        `env:"AUTH_TOKEN_STORE" envDefault:"memory" yaml:"token_store"`
+	TokenFile            string        `env:"AUTH_TOKEN_FILE" envDefault:"launcher-tokens.db" yaml:"token_file"`
+	RedisUrl             string        `env:"AUTH_REDIS_URL" yaml:"redis_url" redact:"true"`
+	TokenCleanupInterval time.Duration `env:"AUTH_TOKEN_CLEANUP_INTERVAL" envDefault:"5m" yaml:"token_cleanup_interval"`
+	CookieKeys           []string      `env:"AUTH_COOKIE_KEYS" yaml:"cookie_keys" redact:"true"`
+
+	OidcConfig OidcConfig `yaml:"oidc"`
+
+	// CookieSecure is auto, true or false. Auto marks cookies Secure when
+	// the launcher is reached over https.
+	CookieSecure   string `env:"AUTH_COOKIE_SECURE" envDefault:"auto" yaml:"cookie_secure"`
+	CookieSameSite string `env:"AUTH_COOKIE_SAME_SITE" envDefault:"lax" yaml:"cookie_same_site"`
+
+	TrustedProxies []string `env:"AUTH_TRUSTED_PROXIES" yaml:"trusted_proxies"`
+	UserHeader     string   `env:"AUTH_USER_HEADER" envDefault:"X-Forwarded-User" yaml:"user_header"`
 }
 
 type Ec2Config struct {
-	Region          string `env:"AWS_REGION"`
-	ImageId         string `env:"EC2_IMAGE_ID"`
-	InstanceType    string `env:"EC2_INSTANCE_TYPE"`
-	KeyName         string `env:"AWS_KEY_NAME"`
-	SecurityGroupId string `env:"AWS_SECURITY_GROUP_ID"`
-	StartScript     string `env:"EC2_SCRIPT"`
-	Tag             string `env:"EC2_TAG" envDefault:"created-by-launcher"`
-	DiskSize        int64  `env:"EC2_DISK_SIZE" envDefault:"16"`
-	Port            int    `env:"EC2_PORT" envDefault:"0"`
-	UsePrivateDns   bool   `env:"AWS_USE_PRIVATE_DNS" envDefault:"false"`
+	Region          string   `env:"AWS_REGION" yaml:"region"`
+	ImageId         string   `env:"EC2_IMAGE_ID" yaml:"image_id"`
+	InstanceType    string   `env:"EC2_INSTANCE_TYPE" yaml:"instance_type"`
+	InstanceTypes   []string `env:"EC2_INSTANCE_TYPES" yaml:"instance_types"`
+	SubnetIds       []string `env:"EC2_SUBNET_IDS" yaml:"subnet_ids"`
+	KeyName         string   `env:"AWS_KEY_NAME" yaml:"key_name"`
+	SecurityGroupId string   `env:"AWS_SECURITY_GROUP_ID" yaml:"security_group_id"`
+	StartScript     string   `env:"EC2_SCRIPT" yaml:"script" redact:"true"`
+	StartScriptFile string   `env:"EC2_SCRIPT_FILE" yaml:"script_file"`
+	Tag             string   `env:"EC2_TAG" envDefault:"created-by-launcher" yaml:"tag"`
+	DiskSize        int64    `env:"EC2_DISK_SIZE" envDefault:"16" yaml:"disk_size"`
+	Port            int      `env:"EC2_PORT" envDefault:"0" yaml:"port"`
+	UsePrivateDns   bool     `env:"AWS_USE_PRIVATE_DNS" envDefault:"false" yaml:"use_private_dns"`
+	Persistent      bool     `env:"EC2_PERSISTENT" envDefault:"false" yaml:"persistent"`
+	Hibernate       bool     `env:"EC2_HIBERNATE" envDefault:"false" yaml:"hibernate"`
+	Spot            bool     `env:"EC2_SPOT" envDefault:"false" yaml:"spot"`
+	SpotMaxPrice    string   `env:"EC2_SPOT_MAX_PRICE" yaml:"spot_max_price"`
+	SpotFallback    bool     `env:"EC2_SPOT_FALLBACK" envDefault:"true" yaml:"spot_fallback"`
+}
+
+// Args is a list of command arguments. In the environment it is a JSON array,
+// or split on spaces if it is not one.
+type Args []string
+
+func (a *Args) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if strings.HasPrefix(s, "[") {
+		return json.Unmarshal([]byte(s), (*[]string)(a))
+	}
+	*a = strings.Fields(s)
+	return nil
+}
+
+type DockerConfig struct {
+	Host         string   `env:"DOCKER_HOST" envDefault:"unix:///var/run/docker.sock" yaml:"host"`
+	Image        string   `env:"DOCKER_IMAGE" yaml:"image"`
+	Cmd          Args     `env:"DOCKER_CMD" yaml:"cmd"`
+	Env          []string `env:"DOCKER_ENV" envSeparator:";" yaml:"env" redact:"true"`
+	Ports        []string `env:"DOCKER_PORTS" yaml:"ports"`
+	Volumes      []string `env:"DOCKER_VOLUMES" yaml:"volumes"`
+	Network      string   `env:"DOCKER_NETWORK" yaml:"network"`
+	Label        string   `env:"DOCKER_LABEL" envDefault:"created-by-launcher" yaml:"label"`
+	Memory       int64    `env:"DOCKER_MEMORY_MB" envDefault:"0" yaml:"memory_mb"`
+	Cpus         float64  `env:"DOCKER_CPUS" envDefault:"0" yaml:"cpus"`
+	Port         int      `env:"DOCKER_PORT" envDefault:"80" yaml:"port"`
+	ProxyHost    string   `env:"DOCKER_PROXY_HOST" envDefault:"127.0.0.1" yaml:"proxy_host"`
+	AutoRemove   bool     `env:"DOCKER_AUTO_REMOVE" envDefault:"false" yaml:"auto_remove"`
+	PullIfAbsent bool     `env:"DOCKER_PULL" envDefault:"true" yaml:"pull"`
+}
+
+type ExecConfig struct {
+	Command     string        `env:"EXEC_COMMAND" yaml:"command"`
+	Dir         string        `env:"EXEC_DIR" yaml:"dir"`
+	Env         []string      `env:"EXEC_ENV" envSeparator:";" yaml:"env" redact:"true"`
+	Host        string        `env:"EXEC_HOST" envDefault:"127.0.0.1" yaml:"host"`
+	Port        int           `env:"EXEC_PORT" envDefault:"0" yaml:"port"`
+	StopTimeout time.Duration `env:"EXEC_STOP_TIMEOUT" envDefault:"10s" yaml:"stop_timeout"`
+	LogFile     string        `env:"EXEC_LOG_FILE" yaml:"log_file"`
+	LogLines    int           `env:"EXEC_LOG_LINES" envDefault:"100" yaml:"log_lines"`
+}
+
+type ProbeConfig struct {
+	Enabled  bool          `env:"PROBE_ENABLED" envDefault:"false" yaml:"enabled"`
+	Path     string        `env:"PROBE_PATH" yaml:"path"`
+	Status   []int         `env:"PROBE_STATUS" yaml:"status"`
+	Interval time.Duration `env:"PROBE_INTERVAL" envDefault:"5s" yaml:"interval"`
+	Timeout  time.Duration `env:"PROBE_TIMEOUT" envDefault:"3s" yaml:"timeout"`
+}
+
+type IdleConfig struct {
+	Timeout  time.Duration `env:"IDLE_TIMEOUT" envDefault:"900s" yaml:"timeout"`
+	Action   string        `env:"IDLE_ACTION" yaml:"action"`
+	Interval time.Duration `env:"IDLE_CHECK_INTERVAL" envDefault:"30s" yaml:"interval"`
+}
+
+const (
+	AlarmCloudWatch = "cloudwatch"
+	AlarmIdle       = "idle"
+	AlarmNone       = "none"
+)
+
+const (
+	IdleActionStop      = "stop"
+	IdleActionTerminate = "terminate"
+)
+
+const (
+	BackendEc2    = "ec2"
+	BackendDocker = "docker"
+	BackendExec   = "exec"
+)
+
+type AppConfig struct {
+	Name        string        `env:"APP_NAME" envDefault:"default" yaml:"name"`
+	Hosts       []string      `env:"APP_HOSTS" yaml:"hosts"`
+	PathPrefix  string        `env:"APP_PATH_PREFIX" yaml:"path_prefix"`
+	StripPrefix bool          `env:"APP_STRIP_PREFIX" envDefault:"false" yaml:"strip_prefix"`
+	CacheTtl    time.Duration `env:"CACHE_TTL" envDefault:"1800s" yaml:"cache_ttl"`
+	WaitTime    time.Duration `env:"LAUNCH_WAIT_TIME" envDefault:"31s" yaml:"launch_wait_time"`
+	Backend     string        `env:"BACKEND" envDefault:"ec2" yaml:"backend"`
+	Alarm       string        `env:"ALARM" yaml:"alarm"`
+	// HourlyCost is used to estimate what a running instance has cost.
+	HourlyCost float64 `env:"HOURLY_COST" yaml:"hourly_cost"`
+
+	Ec2Config    Ec2Client    `yaml:"ec2"`
+	DockerConfig DockerConfig `yaml:"docker"`
+	ExecConfig   ExecConfig   `yaml:"exec"`
+	ProbeConfig  ProbeConfig  `yaml:"probe"`
+	IdleConfig   IdleConfig   `yaml:"idle"`
 }
 
 type Config struct {
-	Port     string        `env:"PORT" envDefault:"7890"`
-	Host     string        `env:"HOST"`
-	LogLevel string        `env:"LOG_LEVEL" envDefault:"INFO"`
-	CacheTtl time.Duration `env:"CACHE_TTL" envDefault:"1800s"`
-	WaitTime time.Duration `env:"LAUNCH_WAIT_TIME" envDefault:"31s"`
+	File          string        `yaml:"-"`
+	Port          string        `env:"PORT" envDefault:"7890" yaml:"port"`
+	Host          string        `env:"HOST" yaml:"host"`
+	LogLevel      string        `env:"LOG_LEVEL" envDefault:"INFO" yaml:"log_level"`
+	LogFormat     string        `env:"LOG_FORMAT" envDefault:"json" yaml:"log_format"`
+	WatchInterval time.Duration `env:"CONFIG_WATCH_INTERVAL" envDefault:"10s" yaml:"watch_interval"`
+	ApiPath       string        `env:"API_PATH" envDefault:"/.launcher/api" yaml:"api_path"`
+	DashboardPath string        `env:"DASHBOARD_PATH" envDefault:"/.launcher/dashboard" yaml:"dashboard_path"`
+	MetricsPath   string        `env:"METRICS_PATH" envDefault:"/.launcher/metrics" yaml:"metrics_path"`
+	AppNames      []string      `env:"APPS" yaml:"-"`
 
-	Ec2Config  Ec2Client
-	AuthConfig AuthConfig
+	AppConfig  `yaml:",inline"`
+	Apps       []AppConfig `yaml:"-"`
+	AuthConfig AuthConfig  `yaml:"auth"`
+}
+
+type configFile struct {
+	Config `yaml:",inline"`
+	Apps   []yaml.Node `yaml:"apps"`
 }
 
 func (c *Config) Addr() string {
@@ -44,17 +226,574 @@ func (c *Config) Addr() string {
 }
 
 func ConfigFromEnv() Config {
+	c, err := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// LoadConfig reads the config from the YAML file at path, if any, and then
+// applies the environment variables that are set on top of it.
+func LoadConfig(path string) (Config, error) {
 	c := Config{}
 
-	err := env.Parse(&c)
+	err := env.ParseWithOptions(&c, env.Options{Environment: map[string]string{}})
 	if err != nil {
-		log.Fatal(err)
+		return c, err
+	}
+	c.File = path
+
+	var appNodes []yaml.Node
+	if path != "" {
+		appNodes, err = readConfigFile(path, &c)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	environ := environMap()
+	if err := applyEnv(&c, environ, ""); err != nil {
+		return c, err
+	}
+
+	switch {
+	case len(appNodes) > 0:
+		for i := range appNodes {
+			ac := c.AppConfig
+			if err := decodeStrict(&appNodes[i], &ac); err != nil {
+				return c, fmt.Errorf("failed to parse %s: apps[%d]: %w", path, i, err)
+			}
+			if err := applyEnv(&ac, environ, appEnvPrefix(ac.Name)); err != nil {
+				return c, err
+			}
+			c.Apps = append(c.Apps, ac)
+		}
+	case len(c.AppNames) > 0:
+		for _, name := range c.AppNames {
+			ac, err := appConfigFromEnv(name, c.AppConfig, environ)
+			if err != nil {
+				return c, err
+			}
+			c.Apps = append(c.Apps, ac)
+		}
+	default:
+		c.Apps = []AppConfig{c.AppConfig}
+	}
+
+	for _, file := range []*string{&c.AuthConfig.UsersFile, &c.AuthConfig.ApiTokensFile} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(filepath.Dir(path), *file)
+		}
+	}
+
+	for i := range c.Apps {
+		if err := c.Apps[i].setDefaults(filepath.Dir(path)); err != nil {
+			return c, err
+		}
+	}
+
+	return c, c.Validate()
+}
+
+func readConfigFile(path string, c *Config) ([]yaml.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	cf := configFile{Config: *c}
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	*c = cf.Config
+	return cf.Apps, nil
+}
+
+func decodeStrict(node *yaml.Node, v any) error {
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+func environMap() map[string]string {
+	environ := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		environ[k] = v
+	}
+	return environ
+}
+
+func appEnvPrefix(name string) string {
+	return strings.ToUpper(name) + "_"
+}
+
+// applyEnv overrides the fields of v with the variables that are actually set
+// in environ. Unlike env.Parse it leaves fields alone if their variable is
+// unset, so values from the config file are not reset to their defaults.
+func applyEnv(v any, environ map[string]string, prefix string) error {
+	parsed := reflect.New(reflect.TypeOf(v).Elem())
+
+	err := env.ParseWithOptions(parsed.Interface(), env.Options{
+		Environment: environ,
+		Prefix:      prefix,
+	})
+	if err != nil {
+		return err
+	}
+
+	copyEnvFields(reflect.ValueOf(v).Elem(), parsed.Elem(), environ, prefix)
+	return nil
+}
+
+func copyEnvFields(dst, src reflect.Value, environ map[string]string, prefix string) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+
+		key, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				copyEnvFields(dst.Field(i), src.Field(i), environ, prefix)
+			}
+			continue
+		}
+
+		if _, ok := environ[prefix+strings.Split(key, ",")[0]]; ok {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// appConfigFromEnv reads the config of an app from variables prefixed with
+// its upper-cased name, e.g. SD_EC2_IMAGE_ID, on top of the shared config.
+func appConfigFromEnv(name string, base AppConfig, environ map[string]string) (AppConfig, error) {
+	prefix := appEnvPrefix(name)
+
+	ac := base
+	if err := applyEnv(&ac, environ, prefix); err != nil {
+		return ac, err
+	}
+
+	ac.Name = name
+
+	// Apps must not share instances, so inherited tags are made unique.
+	if _, ok := environ[prefix+"EC2_TAG"]; !ok {
+		ac.Ec2Config.Tag += "-" + name
+	}
+	if _, ok := environ[prefix+"DOCKER_LABEL"]; !ok {
+		ac.DockerConfig.Label += "-" + name
+	}
+
+	return ac, nil
+}
+
+func (ac *AppConfig) setDefaults(dir string) error {
+	if ac.Alarm == "" {
+		switch ac.Backend {
+		case BackendEc2:
+			ac.Alarm = AlarmCloudWatch
+		case BackendExec:
+			ac.Alarm = AlarmIdle
+		default:
+			ac.Alarm = AlarmNone
+		}
+	}
+
+	if ac.IdleConfig.Action == "" {
+		ac.IdleConfig.Action = IdleActionTerminate
+		if ac.Backend == BackendEc2 && ac.Ec2Config.Persistent {
+			ac.IdleConfig.Action = IdleActionStop
+		}
+	}
+
+	if file := ac.Ec2Config.StartScriptFile; file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		script, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("app %s: failed to read ec2.script_file: %w", ac.Name, err)
+		}
+		ac.Ec2Config.StartScript = string(script)
+	}
+
+	return nil
+}
+
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return "invalid config:\n  " + strings.Join(msgs, "\n  ")
+}
+
+// Validate checks the whole config up front and reports every problem it
+// finds, rather than letting the first launch fail.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if p, err := strconv.Atoi(c.Port); err != nil || !validPort(p) {
+		fail("port (PORT) must be between 1 and 65535, got %q", c.Port)
+	}
+
+	if c.LogFormat != LogFormatJson && c.LogFormat != LogFormatLogfmt {
+		fail("log_format (LOG_FORMAT) must be %s or %s, got %q", LogFormatJson, LogFormatLogfmt, c.LogFormat)
+	}
+
+	if !strings.HasPrefix(c.ApiPath, "/") {
+		fail("api_path (API_PATH) must start with /, got %q", c.ApiPath)
+	}
+	if !strings.HasPrefix(c.DashboardPath, "/") {
+		fail("dashboard_path (DASHBOARD_PATH) must start with /, got %q", c.DashboardPath)
+	}
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		fail("metrics_path (METRICS_PATH) must start with / or be empty, got %q", c.MetricsPath)
+	}
+
+	if c.WatchInterval < 0 {
+		fail("watch_interval (CONFIG_WATCH_INTERVAL) must not be negative, got %v", c.WatchInterval)
 	}
 
 	authConfig := &c.AuthConfig
-	if authConfig.EnableAuth && (authConfig.Username == "" || authConfig.Password == "") {
-		log.Fatal("AUTH_USERNAME and AUTH_PASSWORD must be set if ENABLE_AUTH is set")
+	if authConfig.EnableAuth {
+		switch authConfig.Mode {
+		case AuthModeForm:
+			if authConfig.UsersFile == "" && (authConfig.Username == "" || authConfig.Password == "") {
+				fail("auth.users_file (AUTH_USERS_FILE), or auth.username (AUTH_USERNAME) and auth.password (AUTH_PASSWORD) must be set if auth is enabled")
+			}
+			if authConfig.Username != "" && authConfig.Password == "" {
+				fail("auth.password (AUTH_PASSWORD) must be set if auth.username (AUTH_USERNAME) is set")
+			}
+		case AuthModeOidc:
+			oc := &authConfig.OidcConfig
+			if u, err := url.Parse(oc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				fail("auth.oidc.issuer (AUTH_OIDC_ISSUER) must be an http(s) URL, got %q", oc.Issuer)
+			}
+			if oc.ClientId == "" {
+				fail("auth.oidc.client_id (AUTH_OIDC_CLIENT_ID) must be set")
+			}
+			if oc.RedirectUrl != "" {
+				if u, err := url.Parse(oc.RedirectUrl); err != nil || !u.IsAbs() {
+					fail("auth.oidc.redirect_url (AUTH_OIDC_REDIRECT_URL) must be an absolute URL, got %q", oc.RedirectUrl)
+				}
+			}
+			if !oc.AllowAll && len(oc.AllowedEmails) == 0 && len(oc.AllowedDomains) == 0 && len(oc.AllowedGroups) == 0 {
+				fail("auth.oidc.allowed_emails, allowed_domains or allowed_groups (AUTH_OIDC_ALLOWED_*) must be set, or auth.oidc.allow_all (AUTH_OIDC_ALLOW_ALL) to let in anyone the provider authenticates")
+			}
+		case AuthModeHeader:
+			if len(authConfig.TrustedProxies) == 0 {
+				fail("auth.trusted_proxies (AUTH_TRUSTED_PROXIES) must be set for the header auth mode")
+			}
+			if authConfig.UserHeader == "" {
+				fail("auth.user_header (AUTH_USER_HEADER) must be set for the header auth mode")
+			}
+		default:
+			fail("auth.mode (AUTH_MODE) must be form, oidc or header, got %q", authConfig.Mode)
+		}
+	}
+	if _, err := parseCidrs(authConfig.TrustedProxies); err != nil {
+		fail("auth.trusted_proxies (AUTH_TRUSTED_PROXIES) %v", err)
+	}
+	if !strings.HasPrefix(authConfig.AuthPath, "/") {
+		fail("auth.path (AUTH_PATH) must start with /, got %q", authConfig.AuthPath)
+	}
+	switch authConfig.TokenStore {
+	case TokenStoreMemory:
+	case TokenStoreBolt:
+		if authConfig.TokenFile == "" {
+			fail("auth.token_file (AUTH_TOKEN_FILE) must be set for the bolt token store")
+		}
+	case TokenStoreRedis:
+		if authConfig.RedisUrl == "" {
+			fail("auth.redis_url (AUTH_REDIS_URL) must be set for the redis token store")
+		}
+	case TokenStoreCookie:
+		if len(authConfig.CookieKeys) == 0 {
+			fail("auth.cookie_keys (AUTH_COOKIE_KEYS) must be set for the cookie token store")
+		}
+		for _, k := range authConfig.CookieKeys {
+			if len(k) < 32 {
+				fail("auth.cookie_keys (AUTH_COOKIE_KEYS) must be at least 32 characters long")
+				break
+			}
+		}
+	default:
+		fail("auth.token_store (AUTH_TOKEN_STORE) must be one of memory, bolt, redis or cookie, got %q", authConfig.TokenStore)
+	}
+	if _, err := ParseRole(authConfig.DefaultRole); err != nil {
+		fail("auth.default_role (AUTH_DEFAULT_ROLE) %v", err)
+	}
+	switch authConfig.CookieSecure {
+	case "auto", "true", "false":
+	default:
+		fail("auth.cookie_secure (AUTH_COOKIE_SECURE) must be auto, true or false, got %q", authConfig.CookieSecure)
+	}
+	switch authConfig.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if authConfig.CookieSecure != "true" {
+			fail("auth.cookie_secure (AUTH_COOKIE_SECURE) must be true when auth.cookie_same_site is none")
+		}
+	default:
+		fail("auth.cookie_same_site (AUTH_COOKIE_SAME_SITE) must be lax, strict or none, got %q", authConfig.CookieSameSite)
+	}
+	if authConfig.LoginMaxAttempts < 0 {
+		fail("auth.login_max_attempts (AUTH_LOGIN_MAX_ATTEMPTS) must not be negative, got %d", authConfig.LoginMaxAttempts)
+	}
+	if authConfig.LoginMaxAttempts > 0 {
+		if authConfig.LoginLockout <= 0 {
+			fail("auth.login_lockout (AUTH_LOGIN_LOCKOUT) must be positive, got %v", authConfig.LoginLockout)
+		}
+		if authConfig.LoginMaxLockout < authConfig.LoginLockout {
+			fail("auth.login_max_lockout (AUTH_LOGIN_MAX_LOCKOUT) must not be less than auth.login_lockout, got %v", authConfig.LoginMaxLockout)
+		}
+	}
+	if authConfig.TokenCleanupInterval <= 0 {
+		fail("auth.token_cleanup_interval (AUTH_TOKEN_CLEANUP_INTERVAL) must be positive, got %v", authConfig.TokenCleanupInterval)
 	}
 
-	return c
+	if len(c.Apps) == 0 {
+		fail("no app is configured")
+	}
+
+	names := make(map[string]bool)
+	owners := make(map[string]string)
+	catchAll := ""
+
+	for i := range c.Apps {
+		ac := &c.Apps[i]
+
+		if ac.Name == "" {
+			fail("apps[%d]: name must be set", i)
+		} else if names[ac.Name] {
+			fail("app %s: name is used more than once", ac.Name)
+		}
+		names[ac.Name] = true
+
+		if len(ac.Hosts) == 0 && (ac.PathPrefix == "" || ac.PathPrefix == "/") {
+			if catchAll != "" {
+				fail("app %s: apps %s and %s both match every request, set hosts or path_prefix", ac.Name, catchAll, ac.Name)
+			}
+			catchAll = ac.Name
+		}
+
+		owner := ""
+		switch ac.Backend {
+		case BackendEc2:
+			owner = "ec2:" + ac.Ec2Config.Region + ":" + ac.Ec2Config.Tag
+		case BackendDocker:
+			owner = "docker:" + ac.DockerConfig.Host + ":" + ac.DockerConfig.Label
+		case BackendExec:
+			owner = fmt.Sprintf("exec:%s:%d", ac.ExecConfig.Host, ac.ExecConfig.Port)
+		}
+		if other, ok := owners[owner]; ok {
+			fail("app %s: shares its instances with app %s, give it its own tag, label or port", ac.Name, other)
+		}
+		owners[owner] = ac.Name
+
+		for _, err := range ac.validate() {
+			errs = append(errs, fmt.Errorf("app %s: %w", ac.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// parseCidrs parses IP ranges, where a plain IP stands for itself.
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("must be IPs or CIDRs, got %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("must be IPs or CIDRs, got %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p <= 65535
+}
+
+// validKeyName reports whether name can be the name of an EC2 key pair, or is
+// empty for instances without one.
+func validKeyName(name string) bool {
+	if len(name) > 255 || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, r := range name {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (ac *AppConfig) validate() []error {
+	var errs []error
+
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if ac.PathPrefix != "" && !strings.HasPrefix(ac.PathPrefix, "/") {
+		fail("path_prefix (APP_PATH_PREFIX) must start with /, got %q", ac.PathPrefix)
+	}
+	for _, h := range ac.Hosts {
+		if h == "" || strings.ContainsAny(h, "/: ") {
+			fail("hosts (APP_HOSTS) must be plain host names, got %q", h)
+		}
+	}
+	if ac.CacheTtl <= 0 {
+		fail("cache_ttl (CACHE_TTL) must be positive, got %v", ac.CacheTtl)
+	}
+	if ac.WaitTime < 0 {
+		fail("launch_wait_time (LAUNCH_WAIT_TIME) must not be negative, got %v", ac.WaitTime)
+	}
+	if ac.HourlyCost < 0 {
+		fail("hourly_cost (HOURLY_COST) must not be negative, got %v", ac.HourlyCost)
+	}
+
+	switch ac.Backend {
+	case BackendEc2:
+		ec := &ac.Ec2Config
+		if ec.Region == "" {
+			fail("ec2.region (AWS_REGION) must be set")
+		}
+		if ec.ImageId == "" {
+			fail("ec2.image_id (EC2_IMAGE_ID) must be set")
+		}
+		if ec.InstanceType == "" && len(ec.InstanceTypes) == 0 {
+			fail("ec2.instance_type (EC2_INSTANCE_TYPE) or ec2.instance_types (EC2_INSTANCE_TYPES) must be set")
+		}
+		if ec.SecurityGroupId == "" {
+			fail("ec2.security_group_id (AWS_SECURITY_GROUP_ID) must be set")
+		}
+		if !validKeyName(ec.KeyName) {
+			fail("ec2.key_name (AWS_KEY_NAME) must be up to 255 printable ASCII characters without surrounding spaces, got %q", ec.KeyName)
+		}
+		if ec.Tag == "" {
+			fail("ec2.tag (EC2_TAG) must not be empty")
+		}
+		if ec.DiskSize <= 0 {
+			fail("ec2.disk_size (EC2_DISK_SIZE) must be positive, got %d", ec.DiskSize)
+		}
+		if ec.Port != 0 && !validPort(ec.Port) {
+			fail("ec2.port (EC2_PORT) must be between 1 and 65535, got %d", ec.Port)
+		}
+		if ec.Hibernate && !ec.Persistent {
+			fail("ec2.persistent (EC2_PERSISTENT) must be set if ec2.hibernate (EC2_HIBERNATE) is set")
+		}
+		if ec.SpotMaxPrice != "" {
+			if _, err := strconv.ParseFloat(ec.SpotMaxPrice, 64); err != nil {
+				fail("ec2.spot_max_price (EC2_SPOT_MAX_PRICE) must be a number, got %q", ec.SpotMaxPrice)
+			}
+		}
+	case BackendDocker:
+		dc := &ac.DockerConfig
+		if dc.Image == "" {
+			fail("docker.image (DOCKER_IMAGE) must be set")
+		}
+		if u, err := url.Parse(dc.Host); err != nil || (u.Scheme != "unix" && u.Scheme != "tcp" && u.Scheme != "http") {
+			fail("docker.host (DOCKER_HOST) must be a unix://, tcp:// or http:// address, got %q", dc.Host)
+		}
+		if !validPort(dc.Port) {
+			fail("docker.port (DOCKER_PORT) must be between 1 and 65535, got %d", dc.Port)
+		}
+		if dc.Label == "" {
+			fail("docker.label (DOCKER_LABEL) must not be empty")
+		}
+		if dc.Memory < 0 || dc.Cpus < 0 {
+			fail("docker.memory_mb (DOCKER_MEMORY_MB) and docker.cpus (DOCKER_CPUS) must not be negative")
+		}
+	case BackendExec:
+		xc := &ac.ExecConfig
+		if xc.Command == "" {
+			fail("exec.command (EXEC_COMMAND) must be set")
+		}
+		if !validPort(xc.Port) {
+			fail("exec.port (EXEC_PORT) must be between 1 and 65535, got %d", xc.Port)
+		}
+		if xc.StopTimeout <= 0 {
+			fail("exec.stop_timeout (EXEC_STOP_TIMEOUT) must be positive, got %v", xc.StopTimeout)
+		}
+	default:
+		fail("backend (BACKEND) must be one of ec2, docker or exec, got %q", ac.Backend)
+	}
+
+	pc := &ac.ProbeConfig
+	if pc.Enabled {
+		if pc.Interval <= 0 {
+			fail("probe.interval (PROBE_INTERVAL) must be positive, got %v", pc.Interval)
+		}
+		if pc.Timeout <= 0 {
+			fail("probe.timeout (PROBE_TIMEOUT) must be positive, got %v", pc.Timeout)
+		}
+		if pc.Path != "" && !strings.HasPrefix(pc.Path, "/") {
+			fail("probe.path (PROBE_PATH) must start with /, got %q", pc.Path)
+		}
+		for _, s := range pc.Status {
+			if s < 100 || s > 599 {
+				fail("probe.status (PROBE_STATUS) must be HTTP status codes, got %d", s)
+			}
+		}
+	}
+
+	switch ac.Alarm {
+	case AlarmCloudWatch:
+		if ac.Backend != BackendEc2 {
+			fail("alarm (ALARM) cloudwatch is only supported with the ec2 backend")
+		}
+	case AlarmIdle:
+		ic := &ac.IdleConfig
+		if ic.Timeout <= 0 {
+			fail("idle.timeout (IDLE_TIMEOUT) must be positive, got %v", ic.Timeout)
+		}
+		if ic.Interval <= 0 {
+			fail("idle.interval (IDLE_CHECK_INTERVAL) must be positive, got %v", ic.Interval)
+		}
+		if ic.Action != IdleActionStop && ic.Action != IdleActionTerminate {
+			fail("idle.action (IDLE_ACTION) must be stop or terminate, got %q", ic.Action)
+		}
+	case AlarmNone:
+	default:
+		fail("alarm (ALARM) must be one of cloudwatch, idle or none, got %q", ac.Alarm)
+	}
+
+	return errs
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "launcher.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigUnknownFields(t *testing.T) {
+	tests := []struct {
+		name, content, field string
+	}{
+		{"top level", "backend: exec\nexec:\n  command: serve\n  port: 9\nprot: 80\n", "prot"},
+		{"auth", "backend: exec\nexec:\n  command: serve\n  port: 9\nauth:\n  enabel: true\n", "enabel"},
+		{"backend", "backend: exec\nexec:\n  command: serve\n  prot: 9\n", "prot"},
+		{"app", "backend: exec\nexec:\n  command: serve\napps:\n  - name: wiki\n    backnd: exec\n", "backnd"},
+		{"app only field", "backend: exec\nexec:\n  command: serve\n  port: 9\nApps: []\n", "Apps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeTestConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), "field "+tt.field+" not found") {
+				t.Fatalf("got error %v, want unknown field %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeTestConfig(t, `port: "8080"
+log_level: DEBUG
+backend: exec
+exec:
+  command: serve
+  port: 9000
+apps:
+  - name: wiki
+    hosts: [wiki.example.com]
+  - name: sd
+    path_prefix: /sd
+    exec:
+      port: 9001
+`)
+	t.Setenv("PORT", "9090")
+	t.Setenv("EXEC_COMMAND", "other")
+	t.Setenv("EXEC_PORT", "8000")
+	t.Setenv("EXEC_STOP_TIMEOUT", "3s")
+	t.Setenv("WIKI_EXEC_PORT", "7000")
+	t.Setenv("SD_EXEC_COMMAND", "sd-serve")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment overrides the file, and leaves settings it does not set
+	// alone rather than resetting them to their defaults.
+	if c.Port != "9090" {
+		t.Errorf("got port %s, want it from PORT", c.Port)
+	}
+	if c.LogLevel != "DEBUG" {
+		t.Errorf("got log level %s, want it from the file", c.LogLevel)
+	}
+	if c.LogFormat != LogFormatJson {
+		t.Errorf("got log format %s, want the default", c.LogFormat)
+	}
+
+	if len(c.Apps) != 2 {
+		t.Fatalf("got %d apps, want 2", len(c.Apps))
+	}
+	wiki, sd := &c.Apps[0].ExecConfig, &c.Apps[1].ExecConfig
+
+	// Variables prefixed with the app name override the settings of the app,
+	// which override the shared settings from the file and the environment.
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"wiki command", wiki.Command, "other"},
+		{"wiki port", wiki.Port, 7000},
+		{"wiki stop timeout", wiki.StopTimeout, 3 * time.Second},
+		{"sd command", sd.Command, "sd-serve"},
+		{"sd port", sd.Port, 9001},
+		{"sd stop timeout", sd.StopTimeout, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s is %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigAppsFromEnv(t *testing.T) {
+	path := writeTestConfig(t, "backend: exec\nexec:\n  command: serve\n")
+	t.Setenv("APPS", "a,b")
+	t.Setenv("A_EXEC_PORT", "7001")
+	t.Setenv("B_EXEC_PORT", "7002")
+	t.Setenv("B_APP_PATH_PREFIX", "/b")
+	t.Setenv("B_DOCKER_LABEL", "mine")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Apps) != 2 || c.Apps[0].Name != "a" || c.Apps[1].Name != "b" {
+		t.Fatalf("got apps %v, want a and b", c.Apps)
+	}
+	a, b := &c.Apps[0], &c.Apps[1]
+	if a.ExecConfig.Port != 7001 || b.ExecConfig.Port != 7002 || b.PathPrefix != "/b" {
+		t.Errorf("got ports %d and %d, prefix %q, want them from the prefixed variables", a.ExecConfig.Port, b.ExecConfig.Port, b.PathPrefix)
+	}
+	if a.ExecConfig.Command != "serve" || b.ExecConfig.Command != "serve" {
+		t.Errorf("got commands %q and %q, want the shared one", a.ExecConfig.Command, b.ExecConfig.Command)
+	}
+
+	// Inherited tags and labels are made unique, set ones are kept.
+	if a.Ec2Config.Tag != "created-by-launcher-a" || a.DockerConfig.Label != "created-by-launcher-a" {
+		t.Errorf("got tag %q and label %q, want them made unique", a.Ec2Config.Tag, a.DockerConfig.Label)
+	}
+	if b.DockerConfig.Label != "mine" {
+		t.Errorf("got label %q, want it from B_DOCKER_LABEL", b.DockerConfig.Label)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	app := func(f func(ac *AppConfig)) func(c *Config) {
+		return func(c *Config) { f(&c.Apps[0]) }
+	}
+	ec2App := func(f func(ec *Ec2Config)) func(c *Config) {
+		return app(func(ac *AppConfig) {
+			ac.Backend = BackendEc2
+			ac.Ec2Config = Ec2Config{
+				Region:          "us-east-1",
+				ImageId:         "ami-008ea0af82339baa0",
+				InstanceType:    "t3.small",
+				KeyName:         "self-host",
+				SecurityGroupId: "sg-0456e2fd2eb9ce90b",
+				Tag:             "created-by-launcher",
+				DiskSize:        16,
+			}
+			f(&ac.Ec2Config)
+		})
+	}
+	dockerApp := func(f func(dc *DockerConfig)) func(c *Config) {
+		return app(func(ac *AppConfig) {
+			ac.Backend = BackendDocker
+			ac.DockerConfig = DockerConfig{
+				Host:  "unix:///var/run/docker.sock",
+				Image: "nginx",
+				Label: "created-by-launcher",
+				Port:  80,
+			}
+			f(&ac.DockerConfig)
+		})
+	}
+	auth := func(f func(ac *AuthConfig)) func(c *Config) {
+		return func(c *Config) {
+			c.AuthConfig.EnableAuth = true
+			f(&c.AuthConfig)
+		}
+	}
+	oidc := func(f func(oc *OidcConfig)) func(c *Config) {
+		return auth(func(ac *AuthConfig) {
+			ac.Mode = AuthModeOidc
+			ac.OidcConfig = OidcConfig{
+				Issuer:   "https://accounts.example.com",
+				ClientId: "launcher",
+				AllowAll: true,
+			}
+			f(&ac.OidcConfig)
+		})
+	}
+	other := func(name string, f func(ac *AppConfig)) func(c *Config) {
+		return func(c *Config) {
+			ac := c.Apps[0]
+			ac.Name = name
+			f(&ac)
+			c.Apps = append(c.Apps, ac)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"valid ec2", ec2App(func(ec *Ec2Config) {}), ""},
+		{"valid ec2 without key", ec2App(func(ec *Ec2Config) { ec.KeyName = "" }), ""},
+		{"valid docker", dockerApp(func(dc *DockerConfig) {}), ""},
+		{"valid oidc", oidc(func(oc *OidcConfig) {}), ""},
+
+		{"port", func(c *Config) { c.Port = "0" }, "port (PORT)"},
+		{"log format", func(c *Config) { c.LogFormat = "text" }, "log_format"},
+		{"api path", func(c *Config) { c.ApiPath = "api" }, "api_path"},
+		{"dashboard path", func(c *Config) { c.DashboardPath = "dashboard" }, "dashboard_path"},
+		{"metrics path", func(c *Config) { c.MetricsPath = "metrics" }, "metrics_path"},
+		{"watch interval", func(c *Config) { c.WatchInterval = -time.Second }, "watch_interval"},
+
+		{"no users", auth(func(ac *AuthConfig) { ac.Username, ac.Password = "", "" }), "auth.users_file"},
+		{"no password", auth(func(ac *AuthConfig) { ac.Password, ac.UsersFile = "", "users.txt" }), "auth.password"},
+		{"oidc issuer", oidc(func(oc *OidcConfig) { oc.Issuer = "accounts.example.com" }), "auth.oidc.issuer"},
+		{"oidc client id", oidc(func(oc *OidcConfig) { oc.ClientId = "" }), "auth.oidc.client_id"},
+		{"oidc redirect url", oidc(func(oc *OidcConfig) { oc.RedirectUrl = "/callback" }), "auth.oidc.redirect_url"},
+		{"oidc allow list", oidc(func(oc *OidcConfig) { oc.AllowAll = false }), "auth.oidc.allow_all"},
+		{"header proxies", auth(func(ac *AuthConfig) { ac.Mode = AuthModeHeader }), "auth.trusted_proxies"},
+		{"header user header", auth(func(ac *AuthConfig) {
+			ac.Mode, ac.TrustedProxies, ac.UserHeader = AuthModeHeader, []string{"192.0.2.1"}, ""
+		}), "auth.user_header"},
+		{"auth mode", auth(func(ac *AuthConfig) { ac.Mode = "magic" }), "auth.mode"},
+		{"trusted proxies", func(c *Config) { c.AuthConfig.TrustedProxies = []string{"proxy"} }, "auth.trusted_proxies"},
+		{"auth path", func(c *Config) { c.AuthConfig.AuthPath = "auth" }, "auth.path"},
+		{"bolt file", func(c *Config) { c.AuthConfig.TokenStore, c.AuthConfig.TokenFile = TokenStoreBolt, "" }, "auth.token_file"},
+		{"redis url", func(c *Config) { c.AuthConfig.TokenStore = TokenStoreRedis }, "auth.redis_url"},
+		{"cookie keys", func(c *Config) { c.AuthConfig.TokenStore = TokenStoreCookie }, "auth.cookie_keys"},
+		{"short cookie key", func(c *Config) {
+			c.AuthConfig.TokenStore, c.AuthConfig.CookieKeys = TokenStoreCookie, []string{"short"}
+		}, "at least 32 characters"},
+		{"token store", func(c *Config) { c.AuthConfig.TokenStore = "disk" }, "auth.token_store"},
+		{"default role", func(c *Config) { c.AuthConfig.DefaultRole = "root" }, "auth.default_role"},
+		{"cookie secure", func(c *Config) { c.AuthConfig.CookieSecure = "maybe" }, "auth.cookie_secure"},
+		{"same site none", func(c *Config) { c.AuthConfig.CookieSameSite = "none" }, "when auth.cookie_same_site is none"},
+		{"same site", func(c *Config) { c.AuthConfig.CookieSameSite = "loose" }, "auth.cookie_same_site"},
+		{"login attempts", func(c *Config) { c.AuthConfig.LoginMaxAttempts = -1 }, "auth.login_max_attempts"},
+		{"login lockout", func(c *Config) { c.AuthConfig.LoginLockout = 0 }, "auth.login_lockout"},
+		{"login max lockout", func(c *Config) { c.AuthConfig.LoginMaxLockout = time.Second }, "auth.login_max_lockout"},
+		{"token cleanup", func(c *Config) { c.AuthConfig.TokenCleanupInterval = 0 }, "auth.token_cleanup_interval"},
+
+		{"no apps", func(c *Config) { c.Apps = nil }, "no app is configured"},
+		{"app name", app(func(ac *AppConfig) { ac.Name = "" }), "name must be set"},
+		{"duplicate name", other("default", func(ac *AppConfig) {
+			ac.PathPrefix, ac.ExecConfig.Port = "/b", 10
+		}), "used more than once"},
+		{"catch all", other("b", func(ac *AppConfig) { ac.ExecConfig.Port = 10 }), "both match every request"},
+		{"shared instances", other("b", func(ac *AppConfig) { ac.PathPrefix = "/b" }), "shares its instances with app default"},
+
+		{"path prefix", app(func(ac *AppConfig) { ac.PathPrefix = "app" }), "path_prefix"},
+		{"hosts", app(func(ac *AppConfig) { ac.Hosts = []string{"example.com:80"} }), "hosts"},
+		{"cache ttl", app(func(ac *AppConfig) { ac.CacheTtl = 0 }), "cache_ttl"},
+		{"wait time", app(func(ac *AppConfig) { ac.WaitTime = -time.Second }), "launch_wait_time"},
+		{"hourly cost", app(func(ac *AppConfig) { ac.HourlyCost = -1 }), "hourly_cost"},
+		{"backend", app(func(ac *AppConfig) { ac.Backend = "k8s" }), "backend (BACKEND)"},
+
+		{"ec2 region", ec2App(func(ec *Ec2Config) { ec.Region = "" }), "ec2.region"},
+		{"ec2 image", ec2App(func(ec *Ec2Config) { ec.ImageId = "" }), "ec2.image_id"},
+		{"ec2 instance type", ec2App(func(ec *Ec2Config) { ec.InstanceType = "" }), "ec2.instance_type"},
+		{"ec2 security group", ec2App(func(ec *Ec2Config) { ec.SecurityGroupId = "" }), "ec2.security_group_id"},
+		{"ec2 key name spaces", ec2App(func(ec *Ec2Config) { ec.KeyName = " self-host" }), "ec2.key_name"},
+		{"ec2 key name length", ec2App(func(ec *Ec2Config) { ec.KeyName = strings.Repeat("k", 256) }), "ec2.key_name"},
+		{"ec2 key name ascii", ec2App(func(ec *Ec2Config) { ec.KeyName = "clé" }), "ec2.key_name"},
+		{"ec2 key name control", ec2App(func(ec *Ec2Config) { ec.KeyName = "self\nhost" }), "ec2.key_name"},
+		{"ec2 tag", ec2App(func(ec *Ec2Config) { ec.Tag = "" }), "ec2.tag"},
+		{"ec2 disk size", ec2App(func(ec *Ec2Config) { ec.DiskSize = 0 }), "ec2.disk_size"},
+		{"ec2 port", ec2App(func(ec *Ec2Config) { ec.Port = 70000 }), "ec2.port"},
+		{"ec2 hibernate", ec2App(func(ec *Ec2Config) { ec.Hibernate = true }), "ec2.persistent"},
+		{"ec2 spot price", ec2App(func(ec *Ec2Config) { ec.SpotMaxPrice = "cheap" }), "ec2.spot_max_price"},
+
+		{"docker image", dockerApp(func(dc *DockerConfig) { dc.Image = "" }), "docker.image"},
+		{"docker host", dockerApp(func(dc *DockerConfig) { dc.Host = "ssh://docker" }), "docker.host"},
+		{"docker port", dockerApp(func(dc *DockerConfig) { dc.Port = 0 }), "docker.port"},
+		{"docker label", dockerApp(func(dc *DockerConfig) { dc.Label = "" }), "docker.label"},
+		{"docker memory", dockerApp(func(dc *DockerConfig) { dc.Memory = -1 }), "docker.memory_mb"},
+
+		{"exec command", app(func(ac *AppConfig) { ac.ExecConfig.Command = "" }), "exec.command"},
+		{"exec port", app(func(ac *AppConfig) { ac.ExecConfig.Port = 0 }), "exec.port"},
+		{"exec stop timeout", app(func(ac *AppConfig) { ac.ExecConfig.StopTimeout = 0 }), "exec.stop_timeout"},
+
+		{"probe interval", app(func(ac *AppConfig) { ac.ProbeConfig.Enabled, ac.ProbeConfig.Interval = true, 0 }), "probe.interval"},
+		{"probe timeout", app(func(ac *AppConfig) { ac.ProbeConfig.Enabled, ac.ProbeConfig.Timeout = true, 0 }), "probe.timeout"},
+		{"probe path", app(func(ac *AppConfig) { ac.ProbeConfig.Enabled, ac.ProbeConfig.Path = true, "health" }), "probe.path"},
+		{"probe status", app(func(ac *AppConfig) { ac.ProbeConfig.Enabled, ac.ProbeConfig.Status = true, []int{42} }), "probe.status"},
+
+		{"cloudwatch", app(func(ac *AppConfig) { ac.Alarm = AlarmCloudWatch }), "only supported with the ec2 backend"},
+		{"idle timeout", app(func(ac *AppConfig) { ac.IdleConfig.Timeout = 0 }), "idle.timeout"},
+		{"idle interval", app(func(ac *AppConfig) { ac.IdleConfig.Interval = 0 }), "idle.interval"},
+		{"idle action", app(func(ac *AppConfig) { ac.IdleConfig.Action = "sleep" }), "idle.action"},
+		{"alarm", app(func(ac *AppConfig) { ac.Alarm = "pager" }), "alarm (ALARM)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := loadTestConfig(t, "  enable: false\n  username: esh\n  password: hunter2secret\n")
+			tt.change(c)
+
+			err := c.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			errs, ok := err.(ConfigErrors)
+			if !ok || len(errs) != 1 {
+				t.Fatalf("got error %v, want one about %s", err, tt.want)
+			}
+			if !strings.Contains(errs[0].Error(), tt.want) {
+				t.Fatalf("got error %v, want one about %s", errs[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	c := loadTestConfig(t, "  enable: false\n")
+	c.Port = "http"
+	c.Apps[0].CacheTtl = 0
+	c.Apps[0].ExecConfig.Command = ""
+
+	err := c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("got error %v, want 3", err)
+	}
+	for _, want := range []string{"invalid config:\n  port (PORT)", "\n  app default: cache_ttl", "\n  app default: exec.command"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
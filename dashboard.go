@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type DashboardApp struct {
+	*AppStatus
+	State           string
+	Uptime          string
+	Cost            string
+	ShutdownSeconds int
+}
+
+type DashboardPageParams struct {
+	Path     string
+	Csrf     string
+	Username string
+	Apps     []DashboardApp
+	Error    string
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		d = d.Round(time.Minute)
+	}
+	return d.String()
+}
+
+func newDashboardApp(status *AppStatus) DashboardApp {
+	da := DashboardApp{AppStatus: status}
+
+	switch {
+	case !status.Running:
+		da.State = "Asleep"
+	case !status.Ready:
+		da.State = "Booting"
+	case status.Active:
+		da.State = "In use"
+	default:
+		da.State = "Running"
+	}
+
+	if status.UpSince != nil {
+		da.Uptime = formatDuration(time.Since(*status.UpSince))
+	}
+	if status.Cost > 0 {
+		da.Cost = fmt.Sprintf("%.2f", status.Cost)
+	}
+	if status.ShutdownAt != nil {
+		if d := time.Until(*status.ShutdownAt); d > 0 {
+			da.ShutdownSeconds = int(d / time.Second)
+		}
+	}
+
+	return da
+}
+
+func (r *Router) renderDashboard(c echo.Context, path string, code int, errMsg string) error {
+	params := DashboardPageParams{
+		Path:  path,
+		Error: errMsg,
+	}
+	params.Csrf, _ = c.Get("csrf").(string)
+	params.Username, _ = c.Get("Username").(string)
+
+	for _, app := range r.Apps() {
+		status, err := app.Launcher.Status(c)
+		if err != nil {
+			c.Logger().Errorf("Failed to get status of app %s: %v", app.Name, err)
+			status = &AppStatus{Name: app.Name}
+		}
+		params.Apps = append(params.Apps, newDashboardApp(status))
+	}
+
+	return c.Render(code, "DashboardTemplate", params)
+}
+
+// Dashboard shows the apps and their instances to admins. Looking at it never
+// launches an instance.
+func (r *Router) Dashboard(path string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return r.renderDashboard(c, path, http.StatusOK, "")
+	}
+}
+
+// DashboardAction runs an action of the admin API from the buttons of the
+// dashboard.
+func (r *Router) DashboardAction(path string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l, err := r.apiLauncher(c)
+		if err == nil {
+			err = runAction(c, l, c.Param("action"))
+		}
+
+		if he, ok := err.(*echo.HTTPError); ok && he.Code >= http.StatusBadRequest {
+			return r.renderDashboard(c, path, he.Code, fmt.Sprint(he.Message))
+		}
+		if err != nil && !errors.Is(err, errPending) {
+			c.Logger().Errorf("Failed to %s app %s: %v", c.Param("action"), c.Param("name"), err)
+			return r.renderDashboard(c, path, http.StatusInternalServerError, err.Error())
+		}
+
+		return c.Redirect(http.StatusSeeOther, path)
+	}
+}
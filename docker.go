@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	dockerApiVersion     = "v1.41"
+	dockerLabelKey       = "easyselfhost.launcher.name"
+	dockerConfigLabelKey = "easyselfhost.launcher.config"
+
+	// dockerTimeout bounds calls to the docker api, except for pulls, which
+	// are bounded by dockerPullTimeout.
+	dockerTimeout     = 30 * time.Second
+	dockerPullTimeout = 30 * time.Minute
+)
+
+var _ InstanceClient = &DockerClient{}
+
+type DockerClient struct {
+	config *DockerConfig
+	client *http.Client
+	base   string
+	err    error
+}
+
+// NewDockerClient builds the http client for the docker host once, so that
+// connections to the docker api are reused.
+func NewDockerClient(config *DockerConfig) *DockerClient {
+	dc := &DockerClient{config: config}
+	dc.client, dc.base, dc.err = newDockerHttpClient(config.Host)
+	return dc
+}
+
+// Close closes the idle connections to the docker api of a client that is no
+// longer used.
+func (dc *DockerClient) Close() {
+	if dc.client != nil {
+		dc.client.CloseIdleConnections()
+	}
+}
+
+type DockerPortBinding struct {
+	HostIp   string
+	HostPort string
+}
+
+type DockerContainer struct {
+	Id    string
+	Name  string
+	State struct {
+		Status    string
+		Running   bool
+		StartedAt time.Time
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Ports     map[string][]DockerPortBinding
+		Networks  map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+type dockerError struct {
+	Code    int
+	Message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker api error %d: %s", e.Code, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	var de *dockerError
+	return errors.As(err, &de) && de.Code == http.StatusNotFound
+}
+
+func newDockerHttpClient(host string) (*http.Client, string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse docker host: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		MaxIdleConns:    4,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp", "http":
+		return &http.Client{Transport: transport}, fmt.Sprintf("http://%s", u.Host), nil
+	default:
+		return nil, "", fmt.Errorf("unsupported docker host scheme: %s", u.Scheme)
+	}
+}
+
+// requestContext is the context of the request of c, if there is one. The
+// launcher's own work, such as resuming instances on startup, has none.
+func requestContext(c echo.Context) context.Context {
+	if req := c.Request(); req != nil {
+		return req.Context()
+	}
+	return context.Background()
+}
+
+func (dc *DockerClient) do(ctx context.Context, method, path string, query url.Values, body any, out any) error {
+	if dc.err != nil {
+		return dc.err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dockerTimeout)
+		defer cancel()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	u := fmt.Sprintf("%s/%s%s", dc.base, dockerApiVersion, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call docker api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		return &dockerError{Code: resp.StatusCode, Message: msg.Message}
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if p, ok := out.(*dockerProgress); ok {
+		return p.decode(resp.Body)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func parseDockerPort(spec string) (hostIp, hostPort, containerPort string) {
+	parts := strings.Split(spec, ":")
+	containerPort = parts[len(parts)-1]
+	if !strings.Contains(containerPort, "/") {
+		containerPort += "/tcp"
+	}
+
+	switch len(parts) {
+	case 2:
+		hostPort = parts[0]
+	case 3:
+		hostIp = parts[0]
+		hostPort = parts[1]
+	}
+
+	return hostIp, hostPort, containerPort
+}
+
+func (dc *DockerClient) createBody() map[string]any {
+	exposed := map[string]struct{}{
+		fmt.Sprintf("%d/tcp", dc.config.Port): {},
+	}
+	bindings := map[string][]DockerPortBinding{}
+
+	for _, p := range dc.config.Ports {
+		hostIp, hostPort, containerPort := parseDockerPort(p)
+		exposed[containerPort] = struct{}{}
+		bindings[containerPort] = append(bindings[containerPort], DockerPortBinding{
+			HostIp:   hostIp,
+			HostPort: hostPort,
+		})
+	}
+
+	hostConfig := map[string]any{
+		"Binds":        dc.config.Volumes,
+		"PortBindings": bindings,
+		"AutoRemove":   dc.config.AutoRemove,
+		"Memory":       dc.config.Memory * 1024 * 1024,
+		"NanoCpus":     int64(dc.config.Cpus * 1e9),
+	}
+	if dc.config.Network != "" {
+		hostConfig["NetworkMode"] = dc.config.Network
+	}
+
+	labels := map[string]string{
+		dockerLabelKey: dc.config.Label,
+	}
+	body := map[string]any{
+		"Image":        dc.config.Image,
+		"Env":          dc.config.Env,
+		"ExposedPorts": exposed,
+		"Labels":       labels,
+		"HostConfig":   hostConfig,
+	}
+	if len(dc.config.Cmd) > 0 {
+		body["Cmd"] = dc.config.Cmd
+	}
+
+	// Stopped containers are only reused if they were created from the same
+	// settings, which the label tells without keeping the settings around.
+	b, _ := json.Marshal(body)
+	sum := sha256.Sum256(b)
+	labels[dockerConfigLabelKey] = hex.EncodeToString(sum[:8])
+
+	return body
+}
+
+// Images are pulled in the background, as pulls can take minutes. Launches
+// are pending until the pull is done, and the next launch after a failed pull
+// reports its error.
+var pullingImages = struct {
+	sync.Mutex
+	pulling map[string]bool
+	failed  map[string]error
+}{pulling: make(map[string]bool), failed: make(map[string]error)}
+
+func (dc *DockerClient) pullInBackground(logger echo.Logger) error {
+	key := dc.config.Host + " " + dc.config.Image
+
+	pullingImages.Lock()
+	defer pullingImages.Unlock()
+
+	if err, ok := pullingImages.failed[key]; ok {
+		delete(pullingImages.failed, key)
+		return fmt.Errorf("failed to pull image: %w", err)
+	}
+	if pullingImages.pulling[key] {
+		return errPending
+	}
+	pullingImages.pulling[key] = true
+
+	go func() {
+		err := dc.pullImage(logger)
+
+		pullingImages.Lock()
+		defer pullingImages.Unlock()
+
+		delete(pullingImages.pulling, key)
+		if err != nil {
+			logger.Errorf("Failed to pull image %s: %v", dc.config.Image, err)
+			pullingImages.failed[key] = err
+		}
+	}()
+
+	return errPending
+}
+
+func (dc *DockerClient) pullImage(logger echo.Logger) error {
+	image, tag := dc.config.Image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+
+	logger.Infof("Pulling image %s:%s", image, tag)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPullTimeout)
+	defer cancel()
+
+	query := url.Values{
+		"fromImage": []string{image},
+		"tag":       []string{tag},
+	}
+	var progress dockerProgress
+	if err := dc.do(ctx, http.MethodPost, "/images/create", query, nil, &progress); err != nil {
+		return err
+	}
+	return progress.err
+}
+
+// dockerProgress reads the stream of JSON messages that docker answers a pull
+// with. A failed pull still answers 200, with the error in the stream.
+type dockerProgress struct {
+	err error
+}
+
+func (p *dockerProgress) decode(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.ErrorDetail.Message != "" {
+			p.err = errors.New(msg.ErrorDetail.Message)
+		} else if msg.Error != "" {
+			p.err = errors.New(msg.Error)
+		}
+	}
+}
+
+func (dc *DockerClient) inspect(ctx context.Context, id string) (*DockerContainer, error) {
+	ctr := new(DockerContainer)
+	err := dc.do(ctx, http.MethodGet, fmt.Sprintf("/containers/%s/json", id), nil, nil, ctr)
+	if err != nil {
+		return nil, err
+	}
+	return ctr, nil
+}
+
+func (dc *DockerClient) remove(ctx context.Context, id string) error {
+	query := url.Values{
+		"force": []string{"true"},
+	}
+	err := dc.do(ctx, http.MethodDelete, fmt.Sprintf("/containers/%s", id), query, nil, nil)
+	if err != nil && !isDockerNotFound(err) {
+		return fmt.Errorf("failed to remove container: %w", err)
+	}
+	return nil
+}
+
+// stoppedContainer picks the newest stopped container of the app created from
+// the current settings, so that a stopped app starts again with its state.
+// Other stopped containers of the app are removed rather than left to pile
+// up.
+func (dc *DockerClient) stoppedContainer(c echo.Context, body map[string]any) (string, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"label":  {fmt.Sprintf("%s=%s", dockerLabelKey, dc.config.Label)},
+		"status": {"created", "exited", "dead"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var containers []struct {
+		Id     string
+		State  string
+		Labels map[string]string
+	}
+
+	query := url.Values{
+		"all":     []string{"true"},
+		"filters": []string{string(filters)},
+	}
+	err = dc.do(requestContext(c), http.MethodGet, "/containers/json", query, nil, &containers)
+	if err != nil {
+		return "", fmt.Errorf("failed to find stopped containers: %w", err)
+	}
+
+	config := body["Labels"].(map[string]string)[dockerConfigLabelKey]
+
+	// Containers are listed newest first.
+	reuse := ""
+	for _, ctr := range containers {
+		if reuse == "" && ctr.State != "dead" && ctr.Labels[dockerConfigLabelKey] == config {
+			reuse = ctr.Id
+			continue
+		}
+
+		c.Logger().Infof("Removing stopped container %s", ctr.Id)
+		if err := dc.remove(requestContext(c), ctr.Id); err != nil {
+			return "", err
+		}
+	}
+
+	return reuse, nil
+}
+
+func (dc *DockerClient) LaunchInstance(c echo.Context) (*Target, error) {
+	body := dc.createBody()
+
+	id, err := dc.stoppedContainer(c, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != "" {
+		c.Logger().Infof("Starting stopped container %s", id)
+	} else {
+		created := struct {
+			Id string
+		}{}
+
+		err = dc.do(requestContext(c), http.MethodPost, "/containers/create", nil, body, &created)
+		if isDockerNotFound(err) && dc.config.PullIfAbsent {
+			return nil, dc.pullInBackground(c.Logger())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create container: %w", err)
+		}
+
+		id = created.Id
+		c.Logger().Infof("Created container: %s", id)
+	}
+
+	err = dc.do(requestContext(c), http.MethodPost, fmt.Sprintf("/containers/%s/start", id), nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	ctr, err := dc.inspect(requestContext(c), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	url, err := dc.getContainerURL(ctr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	return &Target{
+		URL:      url,
+		Instance: ctr,
+		Started:  ctr.State.StartedAt,
+	}, nil
+}
+
+func (dc *DockerClient) getContainerURL(ctr *DockerContainer) (*url.URL, error) {
+	port := fmt.Sprintf("%d/tcp", dc.config.Port)
+
+	for _, b := range ctr.NetworkSettings.Ports[port] {
+		if b.HostPort != "" {
+			return url.Parse(fmt.Sprintf("http://%s:%s", dc.config.ProxyHost, b.HostPort))
+		}
+	}
+
+	ip := ctr.NetworkSettings.IPAddress
+	if n, ok := ctr.NetworkSettings.Networks[dc.config.Network]; ok && n.IPAddress != "" {
+		ip = n.IPAddress
+	}
+	if ip == "" {
+		for _, n := range ctr.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				ip = n.IPAddress
+				break
+			}
+		}
+	}
+	if ip == "" {
+		return nil, fmt.Errorf("container %s has no address", ctr.Id)
+	}
+
+	return url.Parse(fmt.Sprintf("http://%s:%d", ip, dc.config.Port))
+}
+
+func (dc *DockerClient) FindInstance(c echo.Context) (*Target, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"label":  {fmt.Sprintf("%s=%s", dockerLabelKey, dc.config.Label)},
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []struct {
+		Id string
+	}
+
+	err = dc.do(requestContext(c), http.MethodGet, "/containers/json", url.Values{"filters": []string{string(filters)}}, nil, &containers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find container: %w", err)
+	}
+
+	for _, ctr := range containers {
+		c.Logger().Debugf("Found container %s", ctr.Id)
+
+		inspected, err := dc.inspect(requestContext(c), ctr.Id)
+		if isDockerNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container: %w", err)
+		}
+
+		if !inspected.State.Running {
+			continue
+		}
+
+		url, err := dc.getContainerURL(inspected)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Target{
+			URL:      url,
+			Instance: inspected,
+			Started:  inspected.State.StartedAt,
+		}, nil
+	}
+
+	return nil, errNotFound
+}
+
+func (dc *DockerClient) CheckInstance(instance any) (bool, error) {
+	ctr, ok := instance.(*DockerContainer)
+	if !ok {
+		return false, errors.New("not docker container type")
+	}
+
+	inspected, err := dc.inspect(context.Background(), ctr.Id)
+	if isDockerNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	return inspected.State.Running, nil
+}
+
+func (dc *DockerClient) StopInstance(instance any) error {
+	ctr, ok := instance.(*DockerContainer)
+	if !ok {
+		return errors.New("not docker container type")
+	}
+
+	err := dc.do(context.Background(), http.MethodPost, fmt.Sprintf("/containers/%s/stop", ctr.Id), nil, nil, nil)
+	if err != nil && !isDockerNotFound(err) {
+		return fmt.Errorf("failed to stop container: %w", err)
+	}
+
+	return nil
+}
+
+func (dc *DockerClient) TerminateInstance(instance any) error {
+	ctr, ok := instance.(*DockerContainer)
+	if !ok {
+		return errors.New("not docker container type")
+	}
+
+	return dc.remove(context.Background(), ctr.Id)
+}
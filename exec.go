@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
+)
+
+var _ InstanceClient = &ExecClient{}
+
+type ExecProcess struct {
+	Pid     int
+	Started time.Time
+
+	cmd    *exec.Cmd
+	done   chan struct{}
+	err    error
+	output *lineBuffer
+}
+
+func (p *ExecProcess) Alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *ExecProcess) Output() string {
+	return p.output.String()
+}
+
+type ExecClient struct {
+	config *ExecConfig
+
+	mu   sync.Mutex
+	proc *ExecProcess
+}
+
+func NewExecClient(config *ExecConfig) *ExecClient {
+	return &ExecClient{
+		config: config,
+	}
+}
+
+// SetConfig applies a reloaded config to future launches while keeping track
+// of the running process.
+func (ec *ExecClient) SetConfig(config *ExecConfig) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.config = config
+}
+
+func (ec *ExecClient) getURL() (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("http://%s:%d", ec.config.Host, ec.config.Port))
+}
+
+func (ec *ExecClient) LaunchInstance(c echo.Context) (*Target, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.proc != nil && ec.proc.Alive() {
+		return nil, fmt.Errorf("process %d is still running", ec.proc.Pid)
+	}
+
+	url, err := ec.getURL()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	output := newLineBuffer(ec.config.LogLines)
+	var (
+		w       io.Writer = output
+		logFile *os.File
+	)
+	if ec.config.LogFile != "" {
+		logFile, err = os.OpenFile(ec.config.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = io.MultiWriter(output, logFile)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", ec.config.Command)
+	cmd.Dir = ec.config.Dir
+	cmd.Env = append(os.Environ(), ec.config.Env...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, fmt.Errorf("failed to start process: %w", err)
+	}
+
+	proc := &ExecProcess{
+		Pid:     cmd.Process.Pid,
+		Started: time.Now(),
+		cmd:     cmd,
+		done:    make(chan struct{}),
+		output:  output,
+	}
+	ec.proc = proc
+
+	logger := c.Logger()
+	go func() {
+		proc.err = cmd.Wait()
+		if logFile != nil {
+			logFile.Close()
+		}
+		close(proc.done)
+		fields := elog.JSON{"pid": proc.Pid, "output": proc.Output()}
+		if proc.err != nil {
+			fields["error"] = proc.err
+		}
+		logEvent(logger, elog.INFO, "instance.exit", fields)
+	}()
+
+	c.Logger().Infof("Started process: %d", proc.Pid)
+
+	return &Target{
+		URL:      url,
+		Instance: proc,
+		Started:  proc.Started,
+	}, nil
+}
+
+func (ec *ExecClient) FindInstance(c echo.Context) (*Target, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.proc == nil || !ec.proc.Alive() {
+		return nil, errNotFound
+	}
+
+	c.Logger().Debugf("Found process %d", ec.proc.Pid)
+
+	url, err := ec.getURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Target{
+		URL:      url,
+		Instance: ec.proc,
+		Started:  ec.proc.Started,
+	}, nil
+}
+
+func (ec *ExecClient) CheckInstance(instance any) (bool, error) {
+	proc, ok := instance.(*ExecProcess)
+	if !ok {
+		return false, errors.New("not exec process type")
+	}
+
+	return proc.Alive(), nil
+}
+
+func (ec *ExecClient) StopInstance(instance any) error {
+	proc, ok := instance.(*ExecProcess)
+	if !ok {
+		return errors.New("not exec process type")
+	}
+
+	if !proc.Alive() {
+		return nil
+	}
+
+	ec.mu.Lock()
+	timeout := ec.config.StopTimeout
+	ec.mu.Unlock()
+
+	if err := signalProcessGroup(proc.cmd, false); err != nil {
+		return err
+	}
+
+	select {
+	case <-proc.done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	if err := signalProcessGroup(proc.cmd, true); err != nil {
+		return err
+	}
+	<-proc.done
+	return nil
+}
+
+func (ec *ExecClient) TerminateInstance(instance any) error {
+	return ec.StopInstance(instance)
+}
+
+// Close stops the running process. Processes are started in their own group,
+// so they would outlive the launcher otherwise.
+func (ec *ExecClient) Close() error {
+	ec.mu.Lock()
+	proc := ec.proc
+	ec.mu.Unlock()
+
+	if proc == nil {
+		return nil
+	}
+	return ec.StopInstance(proc)
+}
+
+type lineBuffer struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+	part  string
+}
+
+func newLineBuffer(max int) *lineBuffer {
+	return &lineBuffer{max: max}
+}
+
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines := strings.Split(b.part+string(p), "\n")
+	b.part = lines[len(lines)-1]
+	b.lines = append(b.lines, lines[:len(lines)-1]...)
+	if b.max > 0 && len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+
+	return len(p), nil
+}
+
+func (b *lineBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines := b.lines
+	if b.part != "" {
+		lines = append(lines[:len(lines):len(lines)], b.part)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, kill bool) error {
+	if kill {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(os.Interrupt)
+}
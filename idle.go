@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
+)
+
+var _ AlarmClient = &IdleAlarmClient{}
+
+type activityState struct {
+	lastSeen time.Time
+	active   int
+}
+
+type Activity struct {
+	mu     sync.Mutex
+	states map[string]*activityState
+}
+
+func NewActivity() *Activity {
+	return &Activity{
+		states: make(map[string]*activityState),
+	}
+}
+
+func (a *Activity) state(t *Target) *activityState {
+	s, ok := a.states[t.URL.Host]
+	if !ok {
+		s = new(activityState)
+		a.states[t.URL.Host] = s
+	}
+	return s
+}
+
+func (a *Activity) Touch(t *Target) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.state(t).lastSeen = time.Now()
+}
+
+// Begin records a request to the target and returns a function that must be
+// called once the request, or the connection it upgraded to, is finished.
+func (a *Activity) Begin(t *Target) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.state(t)
+	s.lastSeen = time.Now()
+	s.active++
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		s.lastSeen = time.Now()
+		s.active--
+	}
+}
+
+func (a *Activity) Idle(t *Target) (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.states[t.URL.Host]
+	if !ok || s.active > 0 {
+		return 0, false
+	}
+
+	return time.Since(s.lastSeen), true
+}
+
+// Extend postpones the idle shutdown of the target as if it was last used d
+// from now.
+func (a *Activity) Extend(t *Target, d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.state(t)
+	if until := time.Now().Add(d); until.After(s.lastSeen) {
+		s.lastSeen = until
+	}
+}
+
+// LastSeen returns when the target was last used, and whether it is in use.
+func (a *Activity) LastSeen(t *Target) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.states[t.URL.Host]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.lastSeen, s.active > 0
+}
+
+func (a *Activity) Forget(t *Target) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.states, t.URL.Host)
+}
+
+type IdleAlarmClient struct {
+	client   InstanceClient
+	activity *Activity
+	config   *IdleConfig
+
+	OnShutdown func(t *Target, action string, err error)
+
+	mu      sync.Mutex
+	targets map[string]*Target
+	stop    chan struct{}
+}
+
+func NewIdleAlarmClient(client InstanceClient, activity *Activity, config *IdleConfig) *IdleAlarmClient {
+	return &IdleAlarmClient{
+		client:   client,
+		activity: activity,
+		config:   config,
+		targets:  make(map[string]*Target),
+		stop:     make(chan struct{}),
+	}
+}
+
+// SetConfig applies a reloaded config. Targets that are already watched keep
+// being watched with the new timeout and action.
+func (ia *IdleAlarmClient) SetConfig(client InstanceClient, config *IdleConfig) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+
+	ia.client = client
+	ia.config = config
+}
+
+func (ia *IdleAlarmClient) Close() {
+	close(ia.stop)
+}
+
+func (ia *IdleAlarmClient) AutoTerminate(c echo.Context, t *Target) error {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+
+	if _, ok := ia.targets[t.URL.Host]; ok {
+		return nil
+	}
+
+	c.Logger().Debugf("Shutting down %s after %v of inactivity", t.URL.Host, ia.config.Timeout)
+
+	ia.activity.Touch(t)
+	ia.targets[t.URL.Host] = t
+	return nil
+}
+
+// Forget stops watching a target that was shut down otherwise.
+func (ia *IdleAlarmClient) Forget(t *Target) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+
+	delete(ia.targets, t.URL.Host)
+}
+
+func (ia *IdleAlarmClient) Run(logger echo.Logger) {
+	ia.mu.Lock()
+	interval := ia.config.Interval
+	ia.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ia.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if next := ia.check(logger); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+	}
+}
+
+func (ia *IdleAlarmClient) check(logger echo.Logger) time.Duration {
+	ia.mu.Lock()
+	client, config := ia.client, ia.config
+	var idle []*Target
+	for host, t := range ia.targets {
+		d, ok := ia.activity.Idle(t)
+		if ok && d >= config.Timeout {
+			idle = append(idle, t)
+			delete(ia.targets, host)
+		}
+	}
+	ia.mu.Unlock()
+
+	for _, t := range idle {
+		fields := elog.JSON{
+			"url":     t.URL.String(),
+			"reason":  "idle",
+			"timeout": config.Timeout,
+		}
+		logEvent(logger, elog.INFO, "instance."+config.Action, fields)
+
+		err := shutdownInstance(client, config.Action, t)
+		if err != nil {
+			fields["error"] = err
+			logEvent(logger, elog.ERROR, "instance."+config.Action, fields)
+		}
+
+		ia.activity.Forget(t)
+		if ia.OnShutdown != nil {
+			ia.OnShutdown(t, config.Action, err)
+		}
+	}
+
+	return config.Interval
+}
+
+func shutdownInstance(client InstanceClient, action string, t *Target) error {
+	switch action {
+	case IdleActionStop:
+		return client.StopInstance(t.Instance)
+	case IdleActionTerminate:
+		return client.TerminateInstance(t.Instance)
+	default:
+		return errors.New("unknown idle action")
+	}
+}
@@ -5,20 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/labstack/echo/v4"
 )
 
-var errNotFound = errors.New("Not found")
+var (
+	errNotFound  = errors.New("Not found")
+	errReclaimed = errors.New("Instance reclaimed")
+	// errPending means the instance is starting but has no address yet.
+	errPending = errors.New("Instance is starting")
+)
 
 type InstanceClient interface {
+	// LaunchInstance returns errPending while the instance cannot be reached
+	// yet, along with a target without URL if it was just launched.
 	LaunchInstance(c echo.Context) (*Target, error)
 	FindInstance(c echo.Context) (*Target, error)
 	CheckInstance(instance any) (bool, error)
+	StopInstance(instance any) error
+	TerminateInstance(instance any) error
 }
 
 type AlarmClient interface {
@@ -28,14 +39,39 @@ type AlarmClient interface {
 var (
 	_ InstanceClient = &Ec2Client{}
 	_ AlarmClient    = &Ec2AlarmClient{}
+	_ AlarmClient    = NoopAlarmClient{}
 )
 
-type Ec2Client = Ec2Config
+func NewInstanceClientFromConfig(c *AppConfig) InstanceClient {
+	switch c.Backend {
+	case BackendDocker:
+		return NewDockerClient(&c.DockerConfig)
+	case BackendExec:
+		return NewExecClient(&c.ExecConfig)
+	default:
+		return &c.Ec2Config
+	}
+}
 
-func NewInstanceClientFromConfig(c *Config) InstanceClient {
-	return &c.Ec2Config
+func NewAlarmClientFromConfig(c *AppConfig, cli InstanceClient, activity *Activity) AlarmClient {
+	switch c.Alarm {
+	case AlarmCloudWatch:
+		return &c.Ec2Config
+	case AlarmIdle:
+		return NewIdleAlarmClient(cli, activity, &c.IdleConfig)
+	default:
+		return NoopAlarmClient{}
+	}
 }
 
+type NoopAlarmClient struct{}
+
+func (NoopAlarmClient) AutoTerminate(c echo.Context, t *Target) error {
+	return nil
+}
+
+type Ec2Client = Ec2Config
+
 func (ec *Ec2Client) getSvc() (*ec2.EC2, error) {
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(ec.Region),
@@ -43,6 +79,7 @@ func (ec *Ec2Client) getSvc() (*ec2.EC2, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed create session: %w", err)
 	}
+	countAwsCalls(&sess.Handlers)
 
 	return ec2.New(sess), nil
 
@@ -54,14 +91,30 @@ func (ec *Ec2Client) LaunchInstance(c echo.Context) (*Target, error) {
 		return nil, err
 	}
 
-	c.Logger().Debugf("Start instance with script: %s", ec.StartScript)
+	if ec.Persistent {
+		instance, err := ec.findStoppedInstance(svc)
+		if err == nil {
+			t, err := ec.startInstance(c, svc, instance)
+			if err == nil || !ec.SpotFallback || !isCapacityError(err) {
+				return t, err
+			}
+			if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+				c.Logger().Warnf("Failed to start spot instance, launching on-demand: %v", err)
+			} else {
+				c.Logger().Warnf("Failed to start instance, launching a new one: %v", err)
+			}
+		} else if !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+	}
+
+	c.Logger().Debugf("Start instance with a script of %d bytes", len(ec.StartScript))
 
 	input := &ec2.RunInstancesInput{
 		ImageId:      aws.String(ec.ImageId),
 		InstanceType: aws.String(ec.InstanceType),
 		MinCount:     aws.Int64(1),
 		MaxCount:     aws.Int64(1),
-		KeyName:      aws.String(ec.KeyName),
 		UserData:     aws.String(base64.StdEncoding.EncodeToString([]byte(ec.StartScript))),
 		SecurityGroupIds: []*string{
 			aws.String(ec.SecurityGroupId),
@@ -87,27 +140,283 @@ func (ec *Ec2Client) LaunchInstance(c echo.Context) (*Target, error) {
 		},
 	}
 
-	result, err := svc.RunInstances(input)
+	if ec.KeyName != "" {
+		input.KeyName = aws.String(ec.KeyName)
+	}
+
+	if ec.Persistent {
+		input.InstanceInitiatedShutdownBehavior = aws.String(ec2.ShutdownBehaviorStop)
+	}
+
+	if ec.Hibernate {
+		input.HibernationOptions = &ec2.HibernationOptionsRequest{
+			Configured: aws.Bool(true),
+		}
+		input.BlockDeviceMappings[0].Ebs.Encrypted = aws.Bool(true)
+	}
+
+	var result *ec2.Reservation
+
+markets:
+	for _, spot := range ec.markets() {
+		// Falling back to on-demand only helps if spot had no capacity, not
+		// if an instance type or quota is wrong.
+		fallback := true
+
+		for _, instanceType := range ec.instanceTypes() {
+			for _, subnetId := range ec.subnetIds() {
+				input.InstanceType = aws.String(instanceType)
+				input.SubnetId = nil
+				if subnetId != "" {
+					input.SubnetId = aws.String(subnetId)
+				}
+				input.InstanceMarketOptions = nil
+				if spot {
+					input.InstanceMarketOptions = ec.spotOptions()
+				}
+
+				desc := describeLaunch(instanceType, subnetId, spot)
+				result, err = svc.RunInstances(input)
+				if err == nil {
+					break markets
+				}
+
+				// The AWS SDK retries throttled launches with backoff. If they
+				// are still throttled, other options would only add to it.
+				switch {
+				case isThrottlingError(err):
+					return nil, fmt.Errorf("failed to launch %s, throttled by AWS: %w", desc, err)
+				case isCapacityError(err):
+					c.Logger().Warnf("No capacity for %s, trying next option: %v", desc, err)
+				case isLimitError(err):
+					fallback = false
+					c.Logger().Errorf("Cannot launch %s, check the instance type and quotas: %v", desc, err)
+				default:
+					return nil, fmt.Errorf("failed to launch instance: %w", err)
+				}
+			}
+		}
+
+		if !fallback {
+			break
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to launch instance: %w", err)
 	}
 
-	c.Logger().Infof("Created instance: %v", result)
-
 	if len(result.Instances) == 0 {
 		return nil, fmt.Errorf("failed to launch instance: empty instance")
 	}
 
-	url, err := ec.getInstanceURL(result.Instances[0])
+	instance := result.Instances[0]
+	c.Logger().Infof("Launched instance %s, %s", aws.StringValue(instance.InstanceId), describeInstance(instance))
 
+	t := &Target{
+		Instance:    instance,
+		Description: describeInstance(instance),
+		Started:     aws.TimeValue(instance.LaunchTime),
+	}
+
+	// Fresh instances have no address until they run. The target is returned
+	// without one, so that the launch is counted, and the instance is looked
+	// up by its id until it has one.
+	t.URL, err = ec.getInstanceURL(instance)
+	if errors.Is(err, errPending) {
+		ec.rememberLaunch(aws.StringValue(instance.InstanceId))
+		return t, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse url: %w", err)
 	}
 
-	return &Target{
-		URL:      url,
-		Instance: result.Instances[0],
-	}, nil
+	return t, nil
+}
+
+// Instances that were launched without an address yet, by tag. Right after a
+// launch, they may not be found by their tag yet.
+var launchedInstances = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+func (ec *Ec2Client) rememberLaunch(id string) {
+	launchedInstances.Lock()
+	defer launchedInstances.Unlock()
+
+	launchedInstances.ids[ec.Tag] = id
+}
+
+func (ec *Ec2Client) forgetLaunch(id string) {
+	launchedInstances.Lock()
+	defer launchedInstances.Unlock()
+
+	if launchedInstances.ids[ec.Tag] == id {
+		delete(launchedInstances.ids, ec.Tag)
+	}
+}
+
+// findLaunched describes the instance launched last by its id, until it has
+// an address or is gone.
+func (ec *Ec2Client) findLaunched(c echo.Context, svc *ec2.EC2) (*Target, error) {
+	launchedInstances.Lock()
+	id, ok := launchedInstances.ids[ec.Tag]
+	launchedInstances.Unlock()
+	if !ok {
+		return nil, errNotFound
+	}
+
+	result, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if awsErrorCode(err) == "InvalidInstanceID.NotFound" {
+		// Instances are not described for a moment after the launch.
+		return nil, errPending
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance: %w", err)
+	}
+
+	for _, r := range result.Reservations {
+		for _, instance := range r.Instances {
+			switch aws.StringValue(instance.State.Name) {
+			case ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending:
+				url, err := ec.getInstanceURL(instance)
+				if errors.Is(err, errPending) {
+					return nil, err
+				}
+				ec.forgetLaunch(id)
+				if err != nil {
+					return nil, err
+				}
+
+				c.Logger().Debugf("Launched instance %s has address %s", id, url.Host)
+				return &Target{
+					URL:         url,
+					Instance:    instance,
+					Description: describeInstance(instance),
+					Started:     aws.TimeValue(instance.LaunchTime),
+				}, nil
+			}
+		}
+	}
+
+	ec.forgetLaunch(id)
+	return nil, errNotFound
+}
+
+func (ec *Ec2Client) markets() []bool {
+	if !ec.Spot {
+		return []bool{false}
+	}
+	if ec.SpotFallback {
+		return []bool{true, false}
+	}
+	return []bool{true}
+}
+
+func (ec *Ec2Client) instanceTypes() []string {
+	if len(ec.InstanceTypes) > 0 {
+		return ec.InstanceTypes
+	}
+	return []string{ec.InstanceType}
+}
+
+func (ec *Ec2Client) subnetIds() []string {
+	if len(ec.SubnetIds) > 0 {
+		return ec.SubnetIds
+	}
+	return []string{""}
+}
+
+func describeLaunch(instanceType, subnetId string, spot bool) string {
+	desc := instanceType
+	if spot {
+		desc += " (spot)"
+	}
+	if subnetId != "" {
+		desc += " in " + subnetId
+	}
+	return desc
+}
+
+func describeInstance(instance *ec2.Instance) string {
+	desc := aws.StringValue(instance.InstanceType)
+	if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+		desc += " (spot)"
+	}
+	if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+		desc += " in " + aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	return desc
+}
+
+func (ec *Ec2Client) spotOptions() *ec2.InstanceMarketOptionsRequest {
+	options := &ec2.SpotMarketOptions{
+		SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+		InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+	}
+
+	if ec.Persistent {
+		options.SpotInstanceType = aws.String(ec2.SpotInstanceTypePersistent)
+		options.InstanceInterruptionBehavior = aws.String(ec2.InstanceInterruptionBehaviorStop)
+	}
+
+	if ec.SpotMaxPrice != "" {
+		options.MaxPrice = aws.String(ec.SpotMaxPrice)
+	}
+
+	return &ec2.InstanceMarketOptionsRequest{
+		MarketType:  aws.String(ec2.MarketTypeSpot),
+		SpotOptions: options,
+	}
+}
+
+func awsErrorCode(err error) string {
+	var ae awserr.Error
+	if !errors.As(err, &ae) {
+		return ""
+	}
+	return ae.Code()
+}
+
+func isCapacityError(err error) bool {
+	switch awsErrorCode(err) {
+	case "InsufficientInstanceCapacity",
+		"InsufficientCapacity",
+		"InsufficientHostCapacity",
+		"SpotMaxPriceTooLow",
+		"MaxSpotInstanceCountExceeded",
+		"UnfulfillableCapacity":
+		return true
+	}
+	return false
+}
+
+// isLimitError reports whether an instance type is not offered where it was
+// asked for, or the account is out of quota for it. Another instance type or
+// subnet may work, but these are worth fixing rather than falling back.
+func isLimitError(err error) bool {
+	switch awsErrorCode(err) {
+	case "VcpuLimitExceeded",
+		"Unsupported":
+		return true
+	}
+	return false
+}
+
+// isThrottlingError reports whether the same request may succeed later.
+// Trying other options right away would only add to the throttling.
+func isThrottlingError(err error) bool {
+	switch awsErrorCode(err) {
+	case "RequestLimitExceeded",
+		"Throttling",
+		"ThrottlingException",
+		"ServiceUnavailable",
+		"InternalError":
+		return true
+	}
+	return false
 }
 
 func (ec *Ec2Client) getInstanceURL(instance *ec2.Instance) (*url.URL, error) {
@@ -116,11 +425,21 @@ func (ec *Ec2Client) getInstanceURL(instance *ec2.Instance) (*url.URL, error) {
 		err error
 	)
 
+	host := aws.StringValue(instance.PublicIpAddress)
 	if ec.UsePrivateDns {
-		url, err = url.Parse(fmt.Sprintf("http://%s", *instance.PrivateDnsName))
-	} else {
-		url, err = url.Parse(fmt.Sprintf("http://%s", *instance.PublicIpAddress))
+		host = aws.StringValue(instance.PrivateDnsName)
+	}
+	if host == "" && aws.StringValue(instance.State.Name) == ec2.InstanceStateNamePending {
+		return nil, errPending
+	}
+	if host == "" && ec.UsePrivateDns {
+		return nil, fmt.Errorf("instance %s has no private dns name", aws.StringValue(instance.InstanceId))
 	}
+	if host == "" {
+		return nil, fmt.Errorf("instance %s has no public ip, set use_private_dns (AWS_USE_PRIVATE_DNS) to reach it by its private address", aws.StringValue(instance.InstanceId))
+	}
+
+	url, err = url.Parse(fmt.Sprintf("http://%s", host))
 
 	if err != nil {
 		return nil, err
@@ -150,32 +469,186 @@ func (ec *Ec2Client) FindInstance(c echo.Context) (*Target, error) {
 		},
 	}
 
+	t, err := ec.findLaunched(c, svc)
+	if !errors.Is(err, errNotFound) {
+		return t, err
+	}
+
 	result, err := svc.DescribeInstances(input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find instance: %w", err)
 	}
 
+	// An instance with an address is picked over one that is still pending.
+	pending := false
 	for _, r := range result.Reservations {
 		for _, instance := range r.Instances {
-			c.Logger().Infof("Found instance: %v", instance)
+			c.Logger().Debugf("Found instance %s in state %s", aws.StringValue(instance.InstanceId), aws.StringValue(instance.State.Name))
 
-			if *instance.State.Name == "running" {
+			switch aws.StringValue(instance.State.Name) {
+			case ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending:
 				url, err := ec.getInstanceURL(instance)
+				if errors.Is(err, errPending) {
+					pending = true
+					continue
+				}
 				if err != nil {
 					return nil, err
 				}
 
 				return &Target{
-					URL:      url,
-					Instance: instance,
+					URL:         url,
+					Instance:    instance,
+					Description: describeInstance(instance),
+					Started:     aws.TimeValue(instance.LaunchTime),
 				}, nil
 			}
 		}
 	}
 
+	if pending {
+		return nil, errPending
+	}
 	return nil, errNotFound
 }
 
+func (ec *Ec2Client) findStoppedInstance(svc *ec2.EC2) (*ec2.Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag:name"),
+				Values: []*string{
+					aws.String(ec.Tag),
+				},
+			},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: []*string{
+					aws.String(ec2.InstanceStateNamePending),
+					aws.String(ec2.InstanceStateNameStopping),
+					aws.String(ec2.InstanceStateNameStopped),
+				},
+			},
+		},
+	}
+
+	result, err := svc.DescribeInstances(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find instance: %w", err)
+	}
+
+	var found *ec2.Instance
+	rank := map[string]int{
+		ec2.InstanceStateNamePending:  3,
+		ec2.InstanceStateNameStopped:  2,
+		ec2.InstanceStateNameStopping: 1,
+	}
+
+	for _, r := range result.Reservations {
+		for _, instance := range r.Instances {
+			if found == nil || rank[aws.StringValue(instance.State.Name)] > rank[aws.StringValue(found.State.Name)] {
+				found = instance
+			}
+		}
+	}
+
+	if found == nil {
+		return nil, errNotFound
+	}
+
+	return found, nil
+}
+
+// Instances that are still stopping are started in the background once they
+// have stopped, so that requests do not wait for them.
+var stoppingInstances = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+func (ec *Ec2Client) startWhenStopped(logger echo.Logger, svc *ec2.EC2, id string) {
+	stoppingInstances.Lock()
+	defer stoppingInstances.Unlock()
+
+	if stoppingInstances.ids[id] {
+		return
+	}
+	stoppingInstances.ids[id] = true
+
+	logger.Infof("Waiting for instance %s to stop", id)
+	go func() {
+		defer func() {
+			stoppingInstances.Lock()
+			delete(stoppingInstances.ids, id)
+			stoppingInstances.Unlock()
+		}()
+
+		ids := []*string{aws.String(id)}
+		err := svc.WaitUntilInstanceStopped(&ec2.DescribeInstancesInput{InstanceIds: ids})
+		if err != nil {
+			logger.Errorf("Failed to wait for instance %s to stop: %v", id, err)
+			return
+		}
+
+		logger.Infof("Starting instance %s", id)
+		if _, err := svc.StartInstances(&ec2.StartInstancesInput{InstanceIds: ids}); err != nil {
+			logger.Errorf("Failed to start instance %s: %v", id, err)
+		}
+	}()
+}
+
+// startInstance starts a stopped instance without waiting for it to run. The
+// target is returned while the instance is pending, and the prober or the
+// boot page wait for it to be ready.
+func (ec *Ec2Client) startInstance(c echo.Context, svc *ec2.EC2, instance *ec2.Instance) (*Target, error) {
+	id := aws.StringValue(instance.InstanceId)
+
+	switch aws.StringValue(instance.State.Name) {
+	case ec2.InstanceStateNameStopping:
+		ec.startWhenStopped(c.Logger(), svc, id)
+		return nil, errPending
+	case ec2.InstanceStateNameStopped:
+		c.Logger().Infof("Starting instance %s", id)
+
+		_, err := svc.StartInstances(&ec2.StartInstancesInput{
+			InstanceIds: []*string{
+				instance.InstanceId,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to start instance: %w", err)
+		}
+	}
+
+	describe := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{
+			instance.InstanceId,
+		},
+	}
+	result, err := svc.DescribeInstances(describe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %w", err)
+	}
+
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return nil, errNotFound
+	}
+
+	instance = result.Reservations[0].Instances[0]
+
+	url, err := ec.getInstanceURL(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Target{
+		URL:         url,
+		Instance:    instance,
+		Description: describeInstance(instance),
+		Started:     aws.TimeValue(instance.LaunchTime),
+	}, nil
+}
+
 func (ec *Ec2Client) CheckInstance(instance any) (bool, error) {
 	i, ok := instance.(*ec2.Instance)
 	if !ok {
@@ -204,23 +677,94 @@ func (ec *Ec2Client) CheckInstance(instance any) (bool, error) {
 
 	i = result.Reservations[0].Instances[0]
 
-	if aws.StringValue(i.State.Name) == ec2.InstanceStateNameRunning {
+	switch aws.StringValue(i.State.Name) {
+	case ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending:
 		return true, nil
 	}
 
+	if aws.StringValue(i.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot && i.StateReason != nil {
+		switch aws.StringValue(i.StateReason.Code) {
+		case "Server.SpotInstanceTermination", "Server.SpotInstanceShutdown":
+			return false, errReclaimed
+		}
+	}
+
 	return false, nil
 }
 
-type Ec2AlarmClient = Ec2Config
+func (ec *Ec2Client) StopInstance(instance any) error {
+	i, ok := instance.(*ec2.Instance)
+	if !ok {
+		return errors.New("not EC2 instance type")
+	}
+
+	svc, err := ec.getSvc()
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{
+			i.InstanceId,
+		},
+		Hibernate: aws.Bool(ec.Hibernate),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop instance: %w", err)
+	}
+
+	return nil
+}
+
+func (ec *Ec2Client) TerminateInstance(instance any) error {
+	i, ok := instance.(*ec2.Instance)
+	if !ok {
+		return errors.New("not EC2 instance type")
+	}
 
-func NewAlarmClientFromConfig(config *Config) AlarmClient {
-	return &config.Ec2Config
+	svc, err := ec.getSvc()
+	if err != nil {
+		return err
+	}
+
+	// A persistent spot request would launch the instance again.
+	if id := i.SpotInstanceRequestId; id != nil {
+		_, err = svc.CancelSpotInstanceRequests(&ec2.CancelSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []*string{id},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to cancel spot request: %w", err)
+		}
+	}
+
+	_, err = svc.TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: []*string{
+			i.InstanceId,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate instance: %w", err)
+	}
+
+	return nil
 }
 
+type Ec2AlarmClient = Ec2Config
+
 func (ea *Ec2AlarmClient) AutoTerminate(c echo.Context, t *Target) error {
-	instanceID := t.Instance.InstanceId
+	i, ok := t.Instance.(*ec2.Instance)
+	if !ok {
+		return errors.New("not EC2 instance type")
+	}
+
+	instanceID := i.InstanceId
 	alarmName := fmt.Sprintf("AutoTermintate-%s", *instanceID)
 
+	action, description := "terminate", "Terminate instance if CPU utilization is below 5% for 10 minutes"
+	if ea.Persistent {
+		action, description = "stop", "Stop instance if CPU utilization is below 5% for 10 minutes"
+	}
+
 	c.Logger().Debugf("Setting alarm with region %s", ea.Region)
 
 	sess, err := session.NewSession(&aws.Config{
@@ -230,6 +774,7 @@ func (ea *Ec2AlarmClient) AutoTerminate(c echo.Context, t *Target) error {
 	if err != nil {
 		return err
 	}
+	countAwsCalls(&sess.Handlers)
 
 	svc := cloudwatch.New(sess)
 
@@ -243,7 +788,7 @@ func (ea *Ec2AlarmClient) AutoTerminate(c echo.Context, t *Target) error {
 		Statistic:          aws.String(cloudwatch.StatisticMaximum),
 		Threshold:          aws.Float64(2.0),
 		ActionsEnabled:     aws.Bool(true),
-		AlarmDescription:   aws.String("Terminate instance if CPU utilization is below 5% for 10 minutes"),
+		AlarmDescription:   aws.String(description),
 		Unit:               aws.String(cloudwatch.StandardUnitPercent),
 		Dimensions: []*cloudwatch.Dimension{
 			{
@@ -252,7 +797,7 @@ func (ea *Ec2AlarmClient) AutoTerminate(c echo.Context, t *Target) error {
 			},
 		},
 		AlarmActions: []*string{
-			aws.String(fmt.Sprintf("arn:aws:automate:%s:ec2:terminate", ea.Region)),
+			aws.String(fmt.Sprintf("arn:aws:automate:%s:ec2:%s", ea.Region, action)),
 		},
 	}
 
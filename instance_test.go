@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestInstanceURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		usePrivateDns bool
+		state         string
+		publicIp      string
+		privateDns    string
+		url           string
+		pending       bool
+	}{
+		{"running", false, ec2.InstanceStateNameRunning, "192.0.2.1", "ip-10-0-0-1.ec2.internal", "http://192.0.2.1:8080", false},
+		{"running private", true, ec2.InstanceStateNameRunning, "192.0.2.1", "ip-10-0-0-1.ec2.internal", "http://ip-10-0-0-1.ec2.internal:8080", false},
+		{"pending", false, ec2.InstanceStateNamePending, "", "ip-10-0-0-1.ec2.internal", "", true},
+		{"pending private", true, ec2.InstanceStateNamePending, "", "", "", true},
+		{"running without public ip", false, ec2.InstanceStateNameRunning, "", "ip-10-0-0-1.ec2.internal", "", false},
+		{"running without private dns", true, ec2.InstanceStateNameRunning, "192.0.2.1", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := &Ec2Client{Port: 8080, UsePrivateDns: tt.usePrivateDns}
+			instance := &ec2.Instance{
+				InstanceId: aws.String("i-0123456789abcdef0"),
+				State:      &ec2.InstanceState{Name: aws.String(tt.state)},
+			}
+			if tt.publicIp != "" {
+				instance.PublicIpAddress = aws.String(tt.publicIp)
+			}
+			if tt.privateDns != "" {
+				instance.PrivateDnsName = aws.String(tt.privateDns)
+			}
+
+			url, err := ec.getInstanceURL(instance)
+			if tt.url != "" {
+				if err != nil || url.String() != tt.url {
+					t.Fatalf("got url %v, error %v, want %s", url, err, tt.url)
+				}
+				return
+			}
+			if errors.Is(err, errPending) != tt.pending || err == nil {
+				t.Fatalf("got url %v, error %v, want pending %v", url, err, tt.pending)
+			}
+		})
+	}
+}
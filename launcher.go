@@ -3,13 +3,18 @@ package main
 import (
 	"errors"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
 )
 
 type Cache struct {
+	app    string
 	mu     sync.Mutex
 	target *Target
 	exp    time.Time
@@ -20,9 +25,11 @@ func (c *Cache) Get() (Target, bool) {
 	defer c.mu.Unlock()
 
 	if c.target == nil || time.Now().After(c.exp) {
+		cacheLookups.WithLabelValues(c.app, "miss").Inc()
 		return Target{}, false
 	}
 
+	cacheLookups.WithLabelValues(c.app, "hit").Inc()
 	return *c.target, true
 }
 
@@ -34,35 +41,466 @@ func (c *Cache) Set(target *Target, exp time.Time) {
 	c.exp = exp
 }
 
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.target = nil
+}
+
 func (c *Cache) ClearIfSame(t *Target) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if *t.URL == *c.target.URL {
+	if c.target != nil && *t.URL == *c.target.URL {
 		c.target = nil
 	}
 }
 
-type Launcher struct {
-	cache       *Cache
-	lmu         sync.Mutex
+type launchSettings struct {
+	config      *AppConfig
 	client      InstanceClient
 	alarmClient AlarmClient
-	cacheTtl    time.Duration
-	launchWait  time.Duration
+	prober      *Prober
+	rewrite     map[*regexp.Regexp]string
+}
+
+// LaunchRecord is kept for the recent launches of an app.
+type LaunchRecord struct {
+	Time        time.Time `json:"time"`
+	Url         string    `json:"url,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Username    string    `json:"username,omitempty"`
+}
+
+const maxLaunchRecords = 10
+
+type Launcher struct {
+	cache    *Cache
+	lmu      sync.Mutex
+	activity *Activity
+	// launched is set while an instance that was launched has no address
+	// yet, so that it is treated as created once it is found.
+	launched bool
+
+	hmu      sync.Mutex
+	upSince  map[string]time.Time
+	launches []LaunchRecord
+
+	cmu     sync.Mutex
+	checked map[string]time.Time
+
+	smu      sync.RWMutex
+	settings *launchSettings
+}
+
+func NewLauncerFromConfig(c *AppConfig) *Launcher {
+	l := &Launcher{
+		cache:    &Cache{app: c.Name},
+		activity: NewActivity(),
+		upSince:  make(map[string]time.Time),
+		checked:  make(map[string]time.Time),
+	}
+	l.settings = l.newSettings(c, nil)
+
+	return l
+}
+
+// newSettings builds the settings for c, reusing the parts of old that hold
+// state about running instances where the config allows it.
+func (l *Launcher) newSettings(c *AppConfig, old *launchSettings) *launchSettings {
+	s := &launchSettings{config: c}
+
+	if c.StripPrefix {
+		s.rewrite = stripPrefixRewrite(c.PathPrefix)
+	}
+
+	var (
+		oldClient InstanceClient
+		oldAlarm  AlarmClient
+	)
+	if old != nil {
+		oldClient, oldAlarm = old.client, old.alarmClient
+	}
+
+	if ec, ok := oldClient.(*ExecClient); ok && c.Backend == BackendExec {
+		ec.SetConfig(&c.ExecConfig)
+		s.client = ec
+	} else {
+		s.client = NewInstanceClientFromConfig(c)
+	}
+
+	if ia, ok := oldAlarm.(*IdleAlarmClient); ok && c.Alarm == AlarmIdle {
+		ia.SetConfig(s.client, &c.IdleConfig)
+		s.alarmClient = ia
+	} else {
+		s.alarmClient = NewAlarmClientFromConfig(c, s.client, l.activity)
+		if ia, ok := s.alarmClient.(*IdleAlarmClient); ok {
+			ia.OnShutdown = l.idleShutdown
+		}
+	}
+
+	if old != nil && old.prober != nil && reflect.DeepEqual(old.config.ProbeConfig, c.ProbeConfig) {
+		s.prober = old.prober
+	} else {
+		s.prober = NewProberFromConfig(c)
+	}
+
+	return s
+}
+
+func (l *Launcher) current() *launchSettings {
+	l.smu.RLock()
+	defer l.smu.RUnlock()
+
+	return l.settings
+}
+
+func (l *Launcher) Proxy() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return Proxy(l.activity, l.current().rewrite)(next)(c)
+		}
+	}
+}
+
+// Start picks up an instance left running by a previous launcher process so
+// that it is still shut down when idle, and starts the idle checks.
+func (l *Launcher) Start(c echo.Context) {
+	s := l.current()
+
+	if ia, ok := s.alarmClient.(*IdleAlarmClient); ok {
+		go ia.Run(withField(c.Logger(), "app", s.config.Name))
+	}
+
+	go func() {
+		t, _, err := l.getInstance(c, false)
+		if errors.Is(err, errNotFound) {
+			return
+		}
+		if err != nil {
+			c.Logger().Errorf("Failed to find running instance: %v", err)
+			return
+		}
+
+		c.Logger().Infof("Resuming instance at %s", t.URL.Host)
+		if err := s.alarmClient.AutoTerminate(c, &t); err != nil {
+			c.Logger().Errorf("Failed to set auto terminate: %v", err)
+		}
+	}()
+}
+
+// Reload switches future launches over to c. The cached target, its activity
+// and the login sessions are kept, so running instances stay reachable.
+func (l *Launcher) Reload(c echo.Context, ac *AppConfig) {
+	l.smu.Lock()
+	old := l.settings
+	s := l.newSettings(ac, old)
+	l.settings = s
+	l.smu.Unlock()
+
+	// The process of the exec backend cannot be managed once the app moved
+	// to another backend, so it is stopped.
+	if old.client != s.client {
+		closeClient(c, old.client)
+	}
+	if ia, ok := old.alarmClient.(*IdleAlarmClient); ok && ia != s.alarmClient {
+		ia.Close()
+	}
+	if old.prober != nil && old.prober != s.prober {
+		old.prober.Close()
+	}
+	if ia, ok := s.alarmClient.(*IdleAlarmClient); ok && ia != old.alarmClient {
+		go ia.Run(withField(c.Logger(), "app", s.config.Name))
+	}
+
+	t, ok := l.cache.Get()
+	if !ok {
+		return
+	}
+
+	if old.config.Backend != ac.Backend {
+		if old.config.Backend != BackendExec {
+			c.Logger().Warnf("App %s moved from the %s to the %s backend, instance at %s is no longer managed",
+				ac.Name, old.config.Backend, ac.Backend, t.URL.Host)
+		}
+		l.invalidate(&t)
+		return
+	}
+
+	if alarmChanged(old.config, ac) {
+		if err := s.alarmClient.AutoTerminate(c, &t); err != nil {
+			c.Logger().Errorf("Failed to set auto terminate: %v", err)
+		}
+	}
+	if s.prober != nil && s.prober != old.prober {
+		s.prober.Watch(c.Logger(), &t)
+	}
+}
+
+// alarmChanged reports whether instances need their alarm set again. Alarm
+// clients of cloudwatch are the ec2 config itself, so they are compared by
+// value.
+func alarmChanged(old, new *AppConfig) bool {
+	if old.Alarm != new.Alarm {
+		return true
+	}
+	return new.Alarm == AlarmCloudWatch && !reflect.DeepEqual(old.Ec2Config, new.Ec2Config)
+}
+
+// Close stops the background work of a launcher whose app was removed, or
+// when the launcher exits. The instance itself is left alone, except for the
+// process of the exec backend which cannot outlive the launcher.
+func (l *Launcher) Close(c echo.Context) {
+	s := l.current()
+
+	closeClient(c, s.client)
+
+	if ia, ok := s.alarmClient.(*IdleAlarmClient); ok {
+		ia.Close()
+	}
+	if s.prober != nil {
+		s.prober.Close()
+	}
+}
+
+// closeClient stops the process of an exec client, and closes the idle
+// connections of a docker client.
+func closeClient(c echo.Context, client InstanceClient) {
+	switch cli := client.(type) {
+	case *ExecClient:
+		if err := cli.Close(); err != nil {
+			c.Logger().Errorf("Failed to stop process: %v", err)
+		}
+	case *DockerClient:
+		cli.Close()
+	}
+}
+
+func (l *Launcher) idleShutdown(t *Target, action string, err error) {
+	idleShutdowns.WithLabelValues(l.cache.app, action, resultLabel(err)).Inc()
+	l.invalidate(t)
+}
+
+func (l *Launcher) invalidate(t *Target) {
+	s := l.current()
+
+	l.cache.ClearIfSame(t)
+	l.activity.Forget(t)
+
+	l.hmu.Lock()
+	delete(l.upSince, t.URL.Host)
+	l.hmu.Unlock()
+
+	l.cmu.Lock()
+	delete(l.checked, t.URL.Host)
+	l.cmu.Unlock()
+
+	if ia, ok := s.alarmClient.(*IdleAlarmClient); ok {
+		ia.Forget(t)
+	}
+	if s.prober != nil {
+		s.prober.Forget(t)
+	}
+}
+
+// AppStatus describes the instance of an app.
+type AppStatus struct {
+	Name        string     `json:"name"`
+	Backend     string     `json:"backend"`
+	Running     bool       `json:"running"`
+	Ready       bool       `json:"ready"`
+	Url         string     `json:"url,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Active      bool       `json:"active"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	ShutdownAt  *time.Time `json:"shutdown_at,omitempty"`
+	UpSince     *time.Time `json:"up_since,omitempty"`
+	// Cost is estimated from the hourly cost of the app.
+	Cost     float64        `json:"cost,omitempty"`
+	Launches []LaunchRecord `json:"launches"`
+}
+
+// Status looks up the instance without launching it.
+func (l *Launcher) Status(c echo.Context) (*AppStatus, error) {
+	s := l.current()
+
+	status := &AppStatus{
+		Name:    s.config.Name,
+		Backend: s.config.Backend,
+	}
+
+	t, _, err := l.getInstance(c, false)
+	if errors.Is(err, errNotFound) || errors.Is(err, errPending) {
+		status.Running = errors.Is(err, errPending)
+		_, status.Launches = l.history(nil)
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upSince, launches := l.history(&t)
+	status.Launches = launches
+	if !upSince.IsZero() {
+		status.UpSince = &upSince
+		status.Cost = time.Since(upSince).Hours() * s.config.HourlyCost
+	}
+
+	status.Running = true
+	status.Ready = s.prober == nil || s.prober.Ready(&t)
+	status.Url = t.URL.String()
+	status.Description = t.Description
+
+	lastSeen, active := l.activity.LastSeen(&t)
+	status.Active = active
+	if !lastSeen.IsZero() {
+		status.LastSeen = &lastSeen
+		if _, ok := s.alarmClient.(*IdleAlarmClient); ok && !active {
+			shutdownAt := lastSeen.Add(s.config.IdleConfig.Timeout)
+			status.ShutdownAt = &shutdownAt
+		}
+	}
+
+	return status, nil
 }
 
-func NewLauncerFromConfig(c *Config) *Launcher {
-	cli := NewInstanceClientFromConfig(c)
-	alarmClient := NewAlarmClientFromConfig(c)
+// LaunchInstance launches the instance unless it is running, and sets it up to
+// be shut down like instances launched by requests.
+func (l *Launcher) LaunchInstance(c echo.Context) (Target, bool, error) {
+	s := l.current()
+
+	t, created, err := l.getInstance(c, true)
+	if err != nil {
+		return Target{}, false, err
+	}
+
+	if err := s.alarmClient.AutoTerminate(c, &t); err != nil {
+		return Target{}, false, err
+	}
+	if s.prober != nil {
+		s.prober.Watch(c.Logger(), &t)
+	}
+
+	return t, created, nil
+}
+
+// Shutdown stops or terminates the running instance.
+func (l *Launcher) Shutdown(c echo.Context, action string) error {
+	t, _, err := l.getInstance(c, false)
+	if err != nil {
+		return err
+	}
+
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
 
-	return &Launcher{
-		cache:       new(Cache),
-		cacheTtl:    c.CacheTtl,
-		client:      cli,
-		alarmClient: alarmClient,
-		launchWait:  c.WaitTime,
+	fields := l.eventFields(&t)
+	fields["reason"] = "request"
+	if username, ok := c.Get("Username").(string); ok {
+		fields["user"] = username
 	}
+	logEvent(c.Logger(), elog.INFO, "instance."+action, fields)
+	if err := shutdownInstance(l.current().client, action, &t); err != nil {
+		return err
+	}
+
+	l.invalidate(&t)
+	return nil
+}
+
+// Restart shuts down the instance the way it is shut down when idle, and
+// launches it again.
+func (l *Launcher) Restart(c echo.Context) (Target, error) {
+	err := l.Shutdown(c, l.current().config.IdleConfig.Action)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return Target{}, err
+	}
+
+	t, _, err := l.LaunchInstance(c)
+	return t, err
+}
+
+var errNotIdleAlarm = errors.New("the app is not shut down when idle")
+
+// Extend postpones the idle shutdown of the running instance by d.
+func (l *Launcher) Extend(c echo.Context, d time.Duration) error {
+	s := l.current()
+
+	if _, ok := s.alarmClient.(*IdleAlarmClient); !ok {
+		return errNotIdleAlarm
+	}
+
+	t, _, err := l.getInstance(c, false)
+	if err != nil {
+		return err
+	}
+
+	if err := s.alarmClient.AutoTerminate(c, &t); err != nil {
+		return err
+	}
+	l.activity.Extend(&t, d)
+	return nil
+}
+
+// Flush forgets the cached target, so that the next request looks up the
+// instance again.
+func (l *Launcher) Flush() {
+	l.cache.Clear()
+}
+
+const (
+	proxyErrorRefreshSeconds = 21
+	reclaimedRefreshSeconds  = 3
+	startingRefreshSeconds   = 5
+	asleepRefreshSeconds     = 30
+)
+
+// renderBootPage also counts as activity, so that an instance that takes
+// longer than the idle timeout to boot is not shut down while users wait.
+func (l *Launcher) renderBootPage(c echo.Context, t *Target, seconds int) error {
+	l.activity.Touch(t)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.Render(http.StatusOK, "RefreshTemplate", RefreshPageParams{
+		Title:   "Launcher is on it",
+		Message: "The server is being initialized.",
+		Detail:  t.Description,
+		Emoji:   "🤔",
+		Seconds: seconds,
+	})
+}
+
+// renderStartingPage is shown while an instance starts and has no address to
+// probe yet.
+func (l *Launcher) renderStartingPage(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(startingRefreshSeconds))
+	return c.Render(http.StatusOK, "RefreshTemplate", RefreshPageParams{
+		Title:   "Launcher is on it",
+		Message: "The server is starting.",
+		Emoji:   "🤔",
+		Seconds: startingRefreshSeconds,
+	})
+}
+
+func (l *Launcher) renderReclaimedPage(c echo.Context) error {
+	c.Logger().Warn("Instance was reclaimed, relaunching")
+	c.Response().Header().Set("Retry-After", strconv.Itoa(reclaimedRefreshSeconds))
+	return c.Render(http.StatusServiceUnavailable, "RefreshTemplate", RefreshPageParams{
+		Title:   "Server was reclaimed",
+		Message: "The cloud provider reclaimed the server, relaunching it now.",
+		Emoji:   "🔁",
+		Seconds: reclaimedRefreshSeconds,
+	})
+}
+
+func (l *Launcher) renderAsleepPage(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(asleepRefreshSeconds))
+	return c.Render(http.StatusServiceUnavailable, "RefreshTemplate", RefreshPageParams{
+		Title:   "Server is asleep",
+		Message: "The server is asleep. Ask an operator to start it.",
+		Emoji:   "😴",
+		Seconds: asleepRefreshSeconds,
+	})
 }
 
 func (l *Launcher) HandleProxyError() echo.MiddlewareFunc {
@@ -91,20 +529,36 @@ func (l *Launcher) HandleProxyError() echo.MiddlewareFunc {
 				return err
 			}
 
-			ok, err = l.client.CheckInstance(t.Instance)
+			s := l.current()
+			ok, err = l.checkInstance(c, t)
+			if errors.Is(err, errReclaimed) {
+				proxyErrors.WithLabelValues(l.cache.app, proxyErrorReclaimed).Inc()
+				l.invalidate(t)
+				return l.renderReclaimedPage(c)
+			}
 			if err != nil {
+				proxyErrors.WithLabelValues(l.cache.app, proxyErrorCheckFailed).Inc()
 				return err
 			}
 			if !ok {
-				l.cache.ClearIfSame(t)
+				proxyErrors.WithLabelValues(l.cache.app, proxyErrorGone).Inc()
+				l.invalidate(t)
 				return c.Redirect(http.StatusTemporaryRedirect, c.Request().URL.Path)
 			}
 
+			proxyErrors.WithLabelValues(l.cache.app, proxyErrorNotReady).Inc()
+			seconds := proxyErrorRefreshSeconds
+			if s.prober != nil {
+				s.prober.Reset(t)
+				seconds = int(s.prober.RetryAfter(t) / time.Second)
+			}
+
+			c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
 			return c.Render(http.StatusServiceUnavailable, "RefreshTemplate", RefreshPageParams{
 				Title:   "503 Service Unavailable",
 				Message: "Sorry, the server may not be ready right now.",
 				Emoji:   "😔",
-				Seconds: 21,
+				Seconds: seconds,
 			})
 		}
 	}
@@ -115,30 +569,60 @@ func (l *Launcher) Launch() echo.MiddlewareFunc {
 		return func(c echo.Context) error {
 			var t Target
 
+			s := l.current()
+
 			t, ok := l.cache.Get()
 			if ok {
 				c.Set("target", &t)
+				if s.prober != nil && !s.prober.Ready(&t) {
+					if l.dueForCheck(&t) {
+						ok, err := l.checkInstance(c, &t)
+						if errors.Is(err, errReclaimed) {
+							l.invalidate(&t)
+							return l.renderReclaimedPage(c)
+						}
+						if err != nil {
+							return err
+						}
+						if !ok {
+							l.invalidate(&t)
+							return c.Redirect(http.StatusTemporaryRedirect, c.Request().URL.Path)
+						}
+					}
+
+					s.prober.Watch(c.Logger(), &t)
+					return l.renderBootPage(c, &t, int(s.prober.RetryAfter(&t)/time.Second))
+				}
 				return next(c)
 			}
 
-			t, created, err := l.getInstance(c)
+			// Only operators may cause a cold start, viewers can only use a
+			// running instance.
+			launch := roleOf(c) >= RoleOperator
+			t, created, err := l.getInstance(c, launch)
+			if !launch && errors.Is(err, errNotFound) {
+				return l.renderAsleepPage(c)
+			}
+			if errors.Is(err, errPending) {
+				return l.renderStartingPage(c)
+			}
 			if err != nil {
 				return err
 			}
 
-			err = l.alarmClient.AutoTerminate(c, &t)
+			err = s.alarmClient.AutoTerminate(c, &t)
 			if err != nil {
 				return err
 			}
 			c.Set("target", &t)
 
-			if created && l.launchWait > 0 {
-				return c.Render(http.StatusOK, "RefreshTemplate", RefreshPageParams{
-					Title:   "Launcher is on it",
-					Message: "The server is being initialized.",
-					Emoji:   "🤔",
-					Seconds: int(l.launchWait / time.Second),
-				})
+			if s.prober != nil {
+				s.prober.Watch(c.Logger(), &t)
+				if !s.prober.Ready(&t) {
+					return l.renderBootPage(c, &t, int(s.prober.RetryAfter(&t)/time.Second))
+				}
+			} else if created && s.config.WaitTime > 0 {
+				return l.renderBootPage(c, &t, int(s.config.WaitTime/time.Second))
 			}
 
 			return next(c)
@@ -146,7 +630,7 @@ func (l *Launcher) Launch() echo.MiddlewareFunc {
 	}
 }
 
-func (l *Launcher) getInstance(c echo.Context) (Target, bool, error) {
+func (l *Launcher) getInstance(c echo.Context, launch bool) (Target, bool, error) {
 	l.lmu.Lock()
 	defer l.lmu.Unlock()
 
@@ -154,22 +638,180 @@ func (l *Launcher) getInstance(c echo.Context) (Target, bool, error) {
 		return t, false, nil
 	}
 
-	t, err := l.client.FindInstance(c)
+	s := l.current()
+
+	t, err := s.client.FindInstance(c)
 
 	if err != nil && !errors.Is(err, errNotFound) {
 		return Target{}, false, err
 	}
 
 	if err == nil {
-		l.cache.Set(t, time.Now().Add(l.cacheTtl))
-		return *t, false, nil
+		created := l.launched
+		l.launched = false
+
+		logEvent(c.Logger(), elog.INFO, "instance.find", l.eventFields(t))
+		l.record(c, t, false)
+		l.cache.Set(t, time.Now().Add(s.config.CacheTtl))
+		return *t, created, nil
 	}
 
-	t, err = l.client.LaunchInstance(c)
+	if !launch {
+		return Target{}, false, err
+	}
+
+	start := time.Now()
+	t, err = s.client.LaunchInstance(c)
+	if errors.Is(err, errPending) && t == nil {
+		return Target{}, false, err
+	}
+
+	// A launched instance without an address yet counts as launched, and is
+	// found by the next requests.
+	pending := errors.Is(err, errPending)
+	if pending {
+		err = nil
+	}
+	coldStarts.WithLabelValues(l.cache.app, resultLabel(err)).Inc()
 	if err != nil {
+		logEvent(c.Logger(), elog.ERROR, "instance.launch", elog.JSON{
+			"app":     s.config.Name,
+			"backend": s.config.Backend,
+			"error":   err,
+		})
 		return Target{}, false, err
 	}
+	coldStartDuration.WithLabelValues(l.cache.app).Observe(time.Since(start).Seconds())
 
-	l.cache.Set(t, time.Now().Add(l.cacheTtl))
+	fields := l.eventFields(t)
+	fields["seconds"] = time.Since(start).Seconds()
+	if username, ok := c.Get("Username").(string); ok {
+		fields["user"] = username
+	}
+	logEvent(c.Logger(), elog.INFO, "instance.launch", fields)
+
+	l.record(c, t, true)
+	l.launched = pending
+	if pending {
+		return Target{}, false, errPending
+	}
+	l.cache.Set(t, time.Now().Add(s.config.CacheTtl))
 	return *t, true, nil
 }
+
+// eventFields describes t in the events of its lifecycle.
+func (l *Launcher) eventFields(t *Target) elog.JSON {
+	s := l.current()
+	fields := elog.JSON{
+		"app":     s.config.Name,
+		"backend": s.config.Backend,
+	}
+	if t.URL != nil {
+		fields["url"] = t.URL.String()
+	}
+	if t.Description != "" {
+		fields["description"] = t.Description
+	}
+	return fields
+}
+
+// Instances that are not ready yet are checked at most this often while the
+// boot page is shown, rather than on every refresh and asset.
+const bootCheckInterval = 15 * time.Second
+
+func (l *Launcher) dueForCheck(t *Target) bool {
+	l.cmu.Lock()
+	defer l.cmu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.checked[t.URL.Host]) < bootCheckInterval {
+		return false
+	}
+	l.checked[t.URL.Host] = now
+	return true
+}
+
+// checkInstance asks the backend whether the instance of t is still there.
+func (l *Launcher) checkInstance(c echo.Context, t *Target) (bool, error) {
+	ok, err := l.current().client.CheckInstance(t.Instance)
+
+	fields := l.eventFields(t)
+	fields["ok"] = ok
+	level := elog.DEBUG
+	if err != nil {
+		fields["error"] = err
+		level = elog.WARN
+	} else if !ok {
+		level = elog.WARN
+	}
+	logEvent(c.Logger(), level, "instance.check", fields)
+
+	return ok, err
+}
+
+// record notes since when a target is up, and keeps the recent launches.
+// Instances are up since their backend started them, so that the uptime and
+// cost survive restarts of the launcher. If the backend does not tell, they
+// are up since the launcher launched or first found them.
+func (l *Launcher) record(c echo.Context, t *Target, created bool) {
+	l.hmu.Lock()
+	defer l.hmu.Unlock()
+
+	now := time.Now()
+	// Targets launched without an address yet are up since they are found.
+	if t.URL != nil {
+		if !t.Started.IsZero() {
+			l.upSince[t.URL.Host] = t.Started
+		} else if _, ok := l.upSince[t.URL.Host]; !ok || created {
+			l.upSince[t.URL.Host] = now
+		}
+	}
+
+	if !created {
+		return
+	}
+
+	record := LaunchRecord{
+		Time:        now,
+		Description: t.Description,
+	}
+	if t.URL != nil {
+		record.Url = t.URL.String()
+	}
+	record.Username, _ = c.Get("Username").(string)
+	l.launches = append(l.launches, record)
+	if len(l.launches) > maxLaunchRecords {
+		l.launches = l.launches[len(l.launches)-maxLaunchRecords:]
+	}
+}
+
+// running returns since when the latest instance the launcher knows of is
+// up, see record.
+func (l *Launcher) running() (time.Time, bool) {
+	l.hmu.Lock()
+	defer l.hmu.Unlock()
+
+	var latest time.Time
+	for _, since := range l.upSince {
+		if since.After(latest) {
+			latest = since
+		}
+	}
+	return latest, len(l.upSince) > 0
+}
+
+func (l *Launcher) history(t *Target) (time.Time, []LaunchRecord) {
+	l.hmu.Lock()
+	defer l.hmu.Unlock()
+
+	var since time.Time
+	if t != nil {
+		since = l.upSince[t.URL.Host]
+	}
+
+	launches := make([]LaunchRecord, len(l.launches))
+	for i, r := range l.launches {
+		launches[len(launches)-1-i] = r
+	}
+	return since, launches
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRecordUpSince(t *testing.T) {
+	config := loadTestConfig(t, "  enable: false\n")
+	u, _ := url.Parse("http://127.0.0.1:9")
+	started := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+
+	// A launcher that finds an instance after a restart counts its uptime
+	// from when the backend started it.
+	for i := 0; i < 2; i++ {
+		l := NewLauncerFromConfig(&config.Apps[0])
+		target := &Target{URL: u, Started: started}
+		l.record(testContext(), target, false)
+		if since, _ := l.history(target); !since.Equal(started) {
+			t.Fatalf("up since %v, want %v", since, started)
+		}
+		if since, ok := l.running(); !ok || !since.Equal(started) {
+			t.Fatalf("running since %v, want %v", since, started)
+		}
+	}
+
+	// Without the start time from the backend, it counts from when the
+	// instance was first found or launched.
+	l := NewLauncerFromConfig(&config.Apps[0])
+	target := &Target{URL: u}
+	before := time.Now()
+	l.record(testContext(), target, false)
+	found, _ := l.history(target)
+	if found.Before(before) {
+		t.Fatalf("up since %v, before it was found at %v", found, before)
+	}
+	l.record(testContext(), target, false)
+	if since, _ := l.history(target); !since.Equal(found) {
+		t.Fatalf("up since %v after finding it again, want %v", since, found)
+	}
+	time.Sleep(time.Millisecond)
+	l.record(testContext(), target, true)
+	if since, _ := l.history(target); !since.After(found) {
+		t.Fatalf("up since %v after launching it again, want after %v", since, found)
+	}
+}
+
+// pendingClient launches instances that have no address until found a given
+// number of times.
+type pendingClient struct {
+	launches int
+	finds    int
+	target   *Target
+}
+
+func (pc *pendingClient) LaunchInstance(c echo.Context) (*Target, error) {
+	pc.launches++
+	return &Target{Instance: pc.target.Instance, Description: pc.target.Description}, errPending
+}
+
+func (pc *pendingClient) FindInstance(c echo.Context) (*Target, error) {
+	if pc.launches == 0 {
+		return nil, errNotFound
+	}
+	if pc.finds--; pc.finds >= 0 {
+		return nil, errPending
+	}
+	return pc.target, nil
+}
+
+func (pc *pendingClient) CheckInstance(instance any) (bool, error) { return true, nil }
+func (pc *pendingClient) StopInstance(instance any) error          { return nil }
+func (pc *pendingClient) TerminateInstance(instance any) error     { return nil }
+
+func TestPendingLaunch(t *testing.T) {
+	config := loadTestConfig(t, "  enable: false\n")
+	u, _ := url.Parse("http://127.0.0.1:9")
+	client := &pendingClient{finds: 2, target: &Target{URL: u, Description: "t3.small"}}
+	l := NewLauncerFromConfig(&config.Apps[0])
+	l.settings.client = client
+	c := testContext()
+
+	if _, _, err := l.getInstance(c, true); !errors.Is(err, errPending) {
+		t.Fatalf("got error %v, want pending", err)
+	}
+	if _, launches := l.history(nil); len(launches) != 1 || launches[0].Description != "t3.small" {
+		t.Fatalf("got launches %v, want the pending launch", launches)
+	}
+
+	// Until the instance has an address, it is looked up rather than
+	// launched again.
+	for i := 0; i < 2; i++ {
+		if _, _, err := l.getInstance(c, true); !errors.Is(err, errPending) {
+			t.Fatalf("got error %v, want pending", err)
+		}
+	}
+	if client.launches != 1 {
+		t.Fatalf("launched %d times, want once", client.launches)
+	}
+
+	target, created, err := l.getInstance(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || target.URL != u {
+		t.Fatalf("got target %v, created %v, want the launched instance", target, created)
+	}
+	if _, ok := l.cache.Get(); !ok {
+		t.Fatal("found instance is not cached")
+	}
+	if _, launches := l.history(nil); len(launches) != 1 {
+		t.Fatalf("got launches %v, want one", launches)
+	}
+
+	l.Flush()
+	if _, created, _ := l.getInstance(c, true); created {
+		t.Fatal("instance is created again when found later")
+	}
+}
+
+func TestReloadStopsExecProcess(t *testing.T) {
+	config := loadTestConfig(t, "  enable: false\n")
+	ac := config.Apps[0]
+	ac.ExecConfig.Command = "sleep 60"
+	ac.ExecConfig.StopTimeout = time.Second
+	l := NewLauncerFromConfig(&ac)
+	c := testContext()
+
+	target, _, err := l.getInstance(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := target.Instance.(*ExecProcess)
+	defer l.current().client.StopInstance(proc)
+
+	// Reloading with the same backend keeps the process.
+	same := ac
+	l.Reload(c, &same)
+	if !proc.Alive() {
+		t.Fatal("process was stopped by a reload with the same backend")
+	}
+
+	moved := ac
+	moved.Backend = BackendDocker
+	moved.DockerConfig.Image = "nginx"
+	l.Reload(c, &moved)
+	select {
+	case <-proc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process is still running after the app moved to another backend")
+	}
+	if _, ok := l.cache.Get(); ok {
+		t.Fatal("target of the stopped process is still cached")
+	}
+}
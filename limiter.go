@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	limiterPruneInterval = time.Minute
+	// limiterMaxKeys bounds the memory taken by failures of made-up usernames.
+	// IPs are counted beyond it.
+	limiterMaxKeys = 10000
+)
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter counts failed logins by key, such as the client IP or the
+// username, and locks a key out with exponential backoff once it fails too
+// often. The first key is the client IP. The others only lock out clients
+// whose IP has failed logins too, so that a user cannot be locked out by
+// someone else failing to log in as them, while an attack spread over many
+// IPs is still slowed down once each of them has failed.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+	pruned   time.Time
+	Clock    func() time.Time
+}
+
+func NewLoginLimiter() *LoginLimiter {
+	clock := func() time.Time {
+		return time.Now()
+	}
+
+	return &LoginLimiter{
+		failures: make(map[string]*loginFailures),
+		Clock:    clock,
+	}
+}
+
+func loginKeys(c echo.Context, username string) []string {
+	return []string{"ip " + c.RealIP(), "user " + strings.ToLower(username)}
+}
+
+// Locked returns how long the longest lockout of the keys still lasts. Keys
+// after the first are ignored if the first has no failures.
+func (l *LoginLimiter) Locked(config *AuthConfig, keys ...string) time.Duration {
+	if config.LoginMaxAttempts == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Clock()
+	var wait time.Duration
+	for i, key := range keys {
+		f, ok := l.failures[key]
+		if !ok || now.Sub(f.last) > config.LoginMaxLockout && now.After(f.lockedUntil) {
+			if i == 0 {
+				break
+			}
+			continue
+		}
+		if f.lockedUntil.Sub(now) > wait {
+			wait = f.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login for the keys, and locks out the keys that have
+// failed too often.
+func (l *LoginLimiter) Fail(c echo.Context, config *AuthConfig, keys ...string) {
+	if config.LoginMaxAttempts == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Clock()
+	l.prune(config, now)
+
+	for i, key := range keys {
+		f, ok := l.failures[key]
+		if !ok && i > 0 && len(l.failures) >= limiterMaxKeys {
+			continue
+		}
+		if !ok || now.Sub(f.last) > config.LoginMaxLockout {
+			f = &loginFailures{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+
+		if f.count < config.LoginMaxAttempts {
+			continue
+		}
+
+		lockout := config.LoginMaxLockout
+		if n := f.count - config.LoginMaxAttempts; n < 32 && config.LoginLockout<<n < lockout {
+			lockout = config.LoginLockout << n
+		}
+		f.lockedUntil = now.Add(lockout)
+		c.Logger().Warnf("Locked out logins by %v for %v after %d failed attempts", key, lockout, f.count)
+	}
+}
+
+// Reset forgets the failed logins of the keys.
+func (l *LoginLimiter) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+func (l *LoginLimiter) prune(config *AuthConfig, now time.Time) {
+	if now.Sub(l.pruned) < limiterPruneInterval && len(l.failures) < limiterMaxKeys {
+		return
+	}
+	l.pruned = now
+
+	for key, f := range l.failures {
+		if now.Sub(f.last) > config.LoginMaxLockout && now.After(f.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) (*LoginLimiter, *AuthConfig) {
+	l := NewLoginLimiter()
+	l.Clock = func() time.Time { return *now }
+	return l, &AuthConfig{
+		LoginMaxAttempts: 3,
+		LoginLockout:     30 * time.Second,
+		LoginMaxLockout:  time.Hour,
+	}
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, config := newTestLimiter(&now)
+	c := testContext()
+	keys := []string{"ip 192.0.2.1", "user bob"}
+
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 30 * time.Second},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{9, 32 * time.Minute},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	failures := 0
+	for _, tt := range tests {
+		for failures < tt.failures {
+			l.Fail(c, config, keys...)
+			failures++
+		}
+		if wait := l.Locked(config, keys...); wait != tt.wait {
+			t.Errorf("after %d failures locked for %v, want %v", tt.failures, wait, tt.wait)
+		}
+	}
+
+	// Failures are forgotten once the lockout is over and LoginMaxLockout
+	// has passed since the last one.
+	now = now.Add(config.LoginMaxLockout + time.Second)
+	if wait := l.Locked(config, keys...); wait != 0 {
+		t.Fatalf("still locked for %v", wait)
+	}
+	l.Fail(c, config, keys...)
+	if wait := l.Locked(config, keys...); wait != 0 {
+		t.Fatalf("locked for %v after the first failure since", wait)
+	}
+}
+
+func TestLoginLimiterUserLockout(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, config := newTestLimiter(&now)
+	c := testContext()
+	attacker := []string{"ip 192.0.2.1", "user bob"}
+	for i := 0; i < config.LoginMaxAttempts; i++ {
+		l.Fail(c, config, attacker...)
+	}
+
+	tests := []struct {
+		name   string
+		keys   []string
+		locked bool
+	}{
+		{"attacker", attacker, true},
+		{"attacker as another user", []string{"ip 192.0.2.1", "user carol"}, true},
+		{"user from a clean IP", []string{"ip 198.51.100.1", "user bob"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if wait := l.Locked(config, tt.keys...); (wait > 0) != tt.locked {
+				t.Fatalf("locked for %v, want locked %v", wait, tt.locked)
+			}
+		})
+	}
+
+	// Once another IP fails too, the user's lockout applies to it.
+	other := []string{"ip 198.51.100.2", "user bob"}
+	l.Fail(c, config, other...)
+	if wait := l.Locked(config, other...); wait == 0 {
+		t.Fatal("user lockout does not apply to a failing IP")
+	}
+}
+
+func TestLoginLimiterReset(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, config := newTestLimiter(&now)
+	c := testContext()
+	keys := []string{"ip 192.0.2.1", "user bob"}
+	for i := 0; i < config.LoginMaxAttempts-1; i++ {
+		l.Fail(c, config, keys...)
+	}
+
+	// A valid login only resets the username, so that an attacker cannot
+	// reset its IP's failures with a login of its own.
+	l.Reset(keys[1:]...)
+	l.Fail(c, config, keys...)
+	if wait := l.Locked(config, keys...); wait != config.LoginLockout {
+		t.Fatalf("locked for %v, want %v by the IP", wait, config.LoginLockout)
+	}
+	if wait := l.Locked(config, "ip 198.51.100.1", "user bob"); wait != 0 {
+		t.Fatalf("user is locked for %v after a reset", wait)
+	}
+}
+
+func TestLoginLimiterDisabled(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, config := newTestLimiter(&now)
+	config.LoginMaxAttempts = 0
+	for i := 0; i < 10; i++ {
+		l.Fail(testContext(), config, "ip 192.0.2.1")
+	}
+	if wait := l.Locked(config, "ip 192.0.2.1"); wait != 0 {
+		t.Fatalf("locked for %v with lockouts disabled", wait)
+	}
+}
+
+func TestLoginLimiterMaxKeys(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, config := newTestLimiter(&now)
+	c := testContext()
+	for i := 0; i < limiterMaxKeys; i++ {
+		l.Fail(c, config, "ip 192.0.2.1", fmt.Sprintf("user made-up-%d", i))
+	}
+	if len(l.failures) > limiterMaxKeys {
+		t.Fatalf("%d keys are kept, want at most %d", len(l.failures), limiterMaxKeys)
+	}
+
+	// IPs are still counted when the limit is reached.
+	for i := 0; i < config.LoginMaxAttempts; i++ {
+		l.Fail(c, config, "ip 198.51.100.1", "user bob")
+	}
+	if wait := l.Locked(config, "ip 198.51.100.1"); wait == 0 {
+		t.Fatal("IP is not locked out when the limit is reached")
+	}
+}
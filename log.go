@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	elog "github.com/labstack/gommon/log"
+)
+
+const (
+	LogFormatJson   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+const redacted = "[REDACTED]"
+
+// Secrets shorter than this are not redacted from messages, as they would
+// mangle unrelated words.
+const minSecretLength = 6
+
+// logSink is shared by a logger and the loggers made from it with With.
+type logSink struct {
+	mu       sync.Mutex
+	format   string
+	replacer *strings.Replacer
+}
+
+// Logger writes one JSON object or logfmt line per entry. It implements
+// echo.Logger so that it can stand in for the logger of echo and of the
+// contexts, and adds its fields, such as the request id, to every entry.
+// The level and output are those of the embedded gommon logger.
+type Logger struct {
+	*elog.Logger
+	sink   *logSink
+	fields []logField
+}
+
+type logField struct {
+	key   string
+	value any
+}
+
+func NewLogger(format string) *Logger {
+	l := &Logger{
+		Logger: elog.New("launcher"),
+		sink:   &logSink{format: format},
+	}
+	l.Logger.SetOutput(os.Stdout)
+	return l
+}
+
+// With returns a logger that adds a field to every entry.
+func (l *Logger) With(key string, value any) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{
+		Logger: l.Logger,
+		sink:   l.sink,
+		fields: append(fields, logField{key, value}),
+	}
+}
+
+// withField adds a field to the entries of logger, if it supports fields.
+func withField(logger echo.Logger, key string, value any) echo.Logger {
+	if l, ok := logger.(*Logger); ok {
+		return l.With(key, value)
+	}
+	return logger
+}
+
+// SetFormat switches all loggers sharing the output of l to format.
+func (l *Logger) SetFormat(format string) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.format = format
+}
+
+// SetSecrets sets the values redacted from all entries, replacing the
+// previous ones.
+func (l *Logger) SetSecrets(secrets []string) {
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	var oldnew []string
+	for _, s := range secrets {
+		if len(s) >= minSecretLength {
+			oldnew = append(oldnew, s, redacted)
+		}
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.replacer = nil
+	if len(oldnew) > 0 {
+		l.sink.replacer = strings.NewReplacer(oldnew...)
+	}
+}
+
+func (l *Logger) Print(i ...any)                 { l.log(0, fmt.Sprint(i...), nil) }
+func (l *Logger) Printf(format string, a ...any) { l.log(0, fmt.Sprintf(format, a...), nil) }
+func (l *Logger) Printj(j elog.JSON)             { l.log(0, "", j) }
+func (l *Logger) Debug(i ...any)                 { l.log(elog.DEBUG, fmt.Sprint(i...), nil) }
+func (l *Logger) Debugf(format string, a ...any) { l.log(elog.DEBUG, fmt.Sprintf(format, a...), nil) }
+func (l *Logger) Debugj(j elog.JSON)             { l.log(elog.DEBUG, "", j) }
+func (l *Logger) Info(i ...any)                  { l.log(elog.INFO, fmt.Sprint(i...), nil) }
+func (l *Logger) Infof(format string, a ...any)  { l.log(elog.INFO, fmt.Sprintf(format, a...), nil) }
+func (l *Logger) Infoj(j elog.JSON)              { l.log(elog.INFO, "", j) }
+func (l *Logger) Warn(i ...any)                  { l.log(elog.WARN, fmt.Sprint(i...), nil) }
+func (l *Logger) Warnf(format string, a ...any)  { l.log(elog.WARN, fmt.Sprintf(format, a...), nil) }
+func (l *Logger) Warnj(j elog.JSON)              { l.log(elog.WARN, "", j) }
+func (l *Logger) Error(i ...any)                 { l.log(elog.ERROR, fmt.Sprint(i...), nil) }
+func (l *Logger) Errorf(format string, a ...any) { l.log(elog.ERROR, fmt.Sprintf(format, a...), nil) }
+func (l *Logger) Errorj(j elog.JSON)             { l.log(elog.ERROR, "", j) }
+
+func (l *Logger) Fatal(i ...any) {
+	l.log(elog.ERROR, fmt.Sprint(i...), nil)
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, a ...any) {
+	l.log(elog.ERROR, fmt.Sprintf(format, a...), nil)
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalj(j elog.JSON) {
+	l.log(elog.ERROR, "", j)
+	os.Exit(1)
+}
+
+func (l *Logger) Panic(i ...any) {
+	msg := fmt.Sprint(i...)
+	l.log(elog.ERROR, msg, nil)
+	panic(msg)
+}
+
+func (l *Logger) Panicf(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	l.log(elog.ERROR, msg, nil)
+	panic(msg)
+}
+
+func (l *Logger) Panicj(j elog.JSON) {
+	l.log(elog.ERROR, "", j)
+	panic(fmt.Sprint(j))
+}
+
+var levelNames = map[elog.Lvl]string{
+	0:          "INFO",
+	elog.DEBUG: "DEBUG",
+	elog.INFO:  "INFO",
+	elog.WARN:  "WARN",
+	elog.ERROR: "ERROR",
+}
+
+// log writes an entry. Print has level 0 and is written at any level.
+func (l *Logger) log(level elog.Lvl, msg string, j elog.JSON) {
+	if level != 0 && level < l.Level() {
+		return
+	}
+
+	fields := []logField{
+		{"time", time.Now().Format(time.RFC3339Nano)},
+		{"level", levelNames[level]},
+	}
+	// Events come first so that they are easy to spot in logfmt.
+	if event, ok := j["event"]; ok {
+		fields = append(fields, logField{"event", event})
+	}
+	if msg != "" {
+		fields = append(fields, logField{"msg", msg})
+	}
+	fields = append(fields, l.fields...)
+
+	keys := make([]string, 0, len(j))
+	for k := range j {
+		if k != "event" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, logField{k, j[k]})
+	}
+
+	if file, line, ok := logCaller(); ok {
+		fields = append(fields, logField{"caller", file + ":" + strconv.Itoa(line)})
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	var buf bytes.Buffer
+	for i, f := range fields {
+		value := l.sink.redact(f.key, f.value)
+		if l.sink.format == LogFormatLogfmt {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(f.key + "=" + logfmtValue(value))
+			continue
+		}
+
+		if i == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		writeJson(&buf, f.key)
+		buf.WriteByte(':')
+		if err := writeJson(&buf, value); err != nil {
+			writeJson(&buf, fmt.Sprint(value))
+		}
+	}
+	if l.sink.format != LogFormatLogfmt {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	l.Output().Write(buf.Bytes())
+}
+
+// writeJson writes v without escaping HTML, which only makes logs harder to
+// read.
+func writeJson(buf *bytes.Buffer, v any) error {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return nil
+}
+
+// logCallerDepth bounds how far up the stack logCaller looks. Entries of the
+// launcher are found within a few frames, echo's middleware chain is deeper.
+const logCallerDepth = 16
+
+var logSourceFile = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return file
+}()
+
+var logSourceDir = filepath.Dir(logSourceFile)
+
+// logCaller finds the first caller in the launcher outside of this file.
+// Entries logged by middleware of echo have none.
+func logCaller() (string, int, bool) {
+	var pcs [logCallerDepth]uintptr
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.File != logSourceFile && filepath.Dir(frame.File) == logSourceDir {
+			return filepath.Base(frame.File), frame.Line, true
+		}
+		if !more {
+			return "", 0, false
+		}
+	}
+}
+
+func (s *logSink) redact(key string, value any) any {
+	if sensitiveKey(key) {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Time:
+		value = v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	if str, ok := value.(string); ok && s.replacer != nil {
+		return s.replacer.Replace(str)
+	}
+	return value
+}
+
+var sensitiveKeyWords = []string{"password", "secret", "token", "user_data", "authorization", "cookie"}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, w := range sensitiveKeyWords {
+		if strings.Contains(key, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func logfmtValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			s = fmt.Sprint(v)
+		} else {
+			s = string(b)
+		}
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// configSecrets collects the values of settings tagged redact, so that they
+// can be kept out of the logs. Settings that are URLs also give away their
+// password, and environment entries their value.
+func configSecrets(config *Config) []string {
+	var secrets []string
+	add := func(s string) {
+		if s == "" {
+			return
+		}
+		secrets = append(secrets, s)
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if p, ok := u.User.Password(); ok {
+				secrets = append(secrets, p)
+			}
+		}
+		if _, v, ok := strings.Cut(s, "="); ok && v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+
+	var walk func(v reflect.Value, redact bool)
+	walk = func(v reflect.Value, redact bool) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				if field.IsExported() {
+					walk(v.Field(i), field.Tag.Get("redact") == "true")
+				}
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), redact)
+			}
+		case reflect.String:
+			if redact {
+				add(v.String())
+			}
+		}
+	}
+	walk(reflect.ValueOf(*config), false)
+
+	return secrets
+}
+
+// logEvent logs a named event, so that events such as instance.launch can be
+// found by name whatever the backend.
+func logEvent(logger echo.Logger, level elog.Lvl, event string, fields elog.JSON) {
+	j := elog.JSON{"event": event}
+	for k, v := range fields {
+		j[k] = v
+	}
+
+	switch level {
+	case elog.DEBUG:
+		logger.Debugj(j)
+	case elog.WARN:
+		logger.Warnj(j)
+	case elog.ERROR:
+		logger.Errorj(j)
+	default:
+		logger.Infoj(j)
+	}
+}
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// RequestId takes the request id from a proxy in front, or makes one up. It is
+// passed on to the backend, returned with the response and added to every
+// entry logged for the request.
+func RequestId() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestId.MatchString(id) {
+				id = newRequestId()
+			}
+			req.Header.Set(echo.HeaderXRequestID, id)
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+			c.SetLogger(withField(c.Logger(), "request_id", id))
+			return next(c)
+		}
+	}
+}
+
+// redactQuery hides the values of query parameters such as tokens and OIDC
+// codes.
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+
+	query := u.Query()
+	for k := range query {
+		if sensitiveKey(k) || k == "code" || k == "state" {
+			query[k] = []string{redacted}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// RequestLogger logs every request as an http.request event.
+func RequestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		HandleError: true,
+		LogStatus:   true,
+		LogURI:      true,
+		LogLatency:  true,
+		LogMethod:   true,
+		LogRemoteIP: true,
+		LogHost:     true,
+		LogError:    true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			uri := v.URI
+			if u, err := url.ParseRequestURI(v.URI); err == nil {
+				uri = redactQuery(u)
+			}
+
+			fields := elog.JSON{
+				"method":     v.Method,
+				"host":       v.Host,
+				"uri":        uri,
+				"status":     v.Status,
+				"latency_ms": float64(v.Latency.Microseconds()) / 1000,
+				"remote_ip":  v.RemoteIP,
+			}
+			if username, ok := c.Get("Username").(string); ok {
+				fields["user"] = username
+			}
+			if app, ok := c.Get("app").(*App); ok {
+				fields["app"] = app.Name
+			}
+
+			level := elog.INFO
+			if v.Error != nil {
+				fields["error"] = v.Error.Error()
+				if v.Status >= 500 {
+					level = elog.ERROR
+				}
+			}
+			logEvent(c.Logger(), level, "http.request", fields)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"testing"
+
+	elog "github.com/labstack/gommon/log"
+)
+
+func TestLogCaller(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(LogFormatJson)
+	l.SetOutput(&buf)
+
+	entry := func(log func()) map[string]any {
+		buf.Reset()
+		log()
+		var fields map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+			t.Fatalf("%v: %s", err, buf.String())
+		}
+		return fields
+	}
+	here := func() string {
+		_, _, line, _ := runtime.Caller(1)
+		return "log_test.go:" + strconv.Itoa(line+1)
+	}
+
+	want := here()
+	got := entry(func() { l.Info("started") })
+	if got["caller"] != want {
+		t.Errorf("got caller %v, want %s", got["caller"], want)
+	}
+
+	want = here()
+	got = entry(func() { logEvent(l.With("request_id", "abc"), elog.INFO, "started", nil) })
+	if got["caller"] != want {
+		t.Errorf("got caller %v through logEvent, want %s", got["caller"], want)
+	}
+
+}
@@ -1,45 +1,194 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	elog "github.com/labstack/gommon/log"
 )
 
+const usage = `Usage: launcher [COMMAND] [ARGS]
+
+Commands:
+  serve            run the launcher, the default
+  status           show the instances of the apps
+  launch           launch the instance of an app
+  stop             stop the instance of an app
+  terminate        terminate the instance of an app
+  validate-config  check the config and report every problem
+  cleanup          remove expired sessions from the token store
+  hash-password    print a users file entry
+  api-token        print an api tokens file entry
+
+Commands read the config from CONFIG_FILE, or the file given with -config,
+and the environment like the server. Run launcher COMMAND -h for the options
+of a command.
+`
+
 func main() {
-	config := ConfigFromEnv()
+	command, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		command, args = os.Args[1], os.Args[2:]
+	}
 
+	var err error
+	switch command {
+	case "serve":
+		serve(ConfigFromEnv())
+	case "status":
+		err = statusCommand(args)
+	case "launch":
+		err = launchCommand(args)
+	case "stop":
+		err = shutdownCommand("stop", IdleActionStop, args)
+	case "terminate":
+		err = shutdownCommand("terminate", IdleActionTerminate, args)
+	case "validate-config":
+		err = validateConfigCommand(args)
+	case "cleanup":
+		err = cleanupCommand(args)
+	case "hash-password":
+		err = hashPasswordCommand(args)
+	case "api-token":
+		err = apiTokenCommand(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		log.Fatalf("unknown command %s", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serve(config Config) {
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
 
-	if config.LogLevel == "DEBUG" {
-		e.Logger.SetLevel(elog.DEBUG)
-		e.Logger.Debug("Log level set to DEBUG")
-	} else {
-		e.Logger.SetLevel(elog.INFO)
-	}
+	logger := NewLogger(config.LogFormat)
+	logger.SetSecrets(configSecrets(&config))
+	e.Logger = logger
+	setLogLevel(e.Logger, config.LogLevel)
 
 	e.Use(middleware.Recover())
-	e.Use(middleware.Logger())
+	e.Use(RequestId())
+	e.Use(RequestLogger())
 
 	var auth *Auth
 
 	e.Renderer = NewPageRenderer()
 	if config.AuthConfig.EnableAuth {
-		auth = NewAuthFromConfig(&config)
+		var err error
+		auth, err = NewAuthFromConfig(&config)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		e.IPExtractor = auth.IPExtractor()
+
+		switch config.AuthConfig.Mode {
+		case AuthModeOidc:
+			e.GET(config.AuthConfig.AuthPath, auth.OidcLogin())
+			e.GET(config.AuthConfig.AuthPath+oidcCallbackPath, auth.OidcCallback())
+		case AuthModeForm:
+			csrf := auth.CSRF(config.AuthConfig.AuthPath)
+			e.GET(config.AuthConfig.AuthPath, AuthPage(&config), csrf)
+			e.POST(config.AuthConfig.AuthPath, auth.Login(), csrf)
+		}
+		e.GET(config.AuthConfig.AuthPath+verifyPath, auth.Verify())
+		csrf := auth.CSRF(config.AuthConfig.AuthPath)
+		e.GET(config.AuthConfig.AuthPath+logoutPath, auth.LogoutPage(), csrf)
+		e.POST(config.AuthConfig.AuthPath+logoutPath, auth.Logout(), csrf)
+
+		admin := []echo.MiddlewareFunc{auth.Authenticate(), RequireRole(RoleAdmin), auth.CSRF(config.AuthConfig.AuthPath)}
+		e.GET(config.AuthConfig.AuthPath+sessionsPath, auth.Sessions(), admin...)
+		e.POST(config.AuthConfig.AuthPath+sessionsPath+"/revoke", auth.RevokeSessions(), admin...)
+	}
 
-		e.GET(config.AuthConfig.AuthPath, AuthPage(&config))
-		e.POST(config.AuthConfig.AuthPath, auth.Login())
+	router := NewRouterFromConfig(&config)
+
+	if auth != nil {
+		router.RegisterApi(e.Group(config.ApiPath, auth.Authenticate(), RequireRole(RoleAdmin), requireNonSimple()))
+
+		dg := e.Group(config.DashboardPath, auth.Authenticate(), RequireRole(RoleAdmin), auth.CSRF(config.DashboardPath))
+		dg.GET("", router.Dashboard(config.DashboardPath))
+		dg.POST("/apps/:name/:action", router.DashboardAction(config.DashboardPath))
+	} else {
+		e.Group(config.ApiPath, RequireAuth("API"))
+		e.Group(config.DashboardPath, RequireAuth("dashboard"))
 	}
 
-	launcher := NewLauncerFromConfig(&config)
+	if config.MetricsPath != "" {
+		var mw []echo.MiddlewareFunc
+		if auth != nil {
+			mw = append(mw, auth.Authenticate(), RequireRole(RoleAdmin))
+		}
+		e.GET(config.MetricsPath, MetricsHandler(router), mw...)
+	}
 
 	pg := e.Group("")
 	if config.AuthConfig.EnableAuth {
 		pg.Use(auth.Authenticate())
 	}
-	pg.Use(launcher.Launch())
-	pg.Use(launcher.HandleProxyError())
-	pg.Use(Proxy)
+	pg.Use(router.Route())
+	pg.Use(router.Metrics())
+	pg.Use(router.Launch())
+	pg.Use(router.HandleProxyError())
+	pg.Use(router.Proxy())
+
+	bg := e.NewContext(nil, nil)
+	router.Start(bg)
+	if auth != nil {
+		auth.Start(bg)
+	}
+
+	reloader := NewReloader(bg, &config)
+	reloader.OnReload(func(c echo.Context, config *Config) {
+		setLogLevel(c.Logger(), config.LogLevel)
+		logger.SetFormat(config.LogFormat)
+		logger.SetSecrets(configSecrets(config))
+	})
+	reloader.OnReload(router.Reload)
+	if auth != nil {
+		reloader.OnReload(auth.Reload)
+	}
+	go reloader.Run()
 
-	e.Logger.Fatal(e.Start(config.Addr()))
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		e.Logger.Infof("Got %v, shutting down", <-sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			e.Logger.Errorf("Failed to shut down server: %v", err)
+		}
+	}()
+
+	e.Logger.Infof("Listening on %s", config.Addr())
+	if err := e.Start(config.Addr()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		e.Logger.Fatal(err)
+	}
+	router.Close(bg)
+}
+
+func setLogLevel(logger echo.Logger, level string) {
+	if level == "DEBUG" {
+		logger.SetLevel(elog.DEBUG)
+		logger.Debug("Log level set to DEBUG")
+	} else {
+		logger.SetLevel(elog.INFO)
+	}
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are labeled by app, and otherwise only with values from small fixed
+// sets, so that scraping them stays cheap.
+var (
+	coldStarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_cold_starts_total",
+		Help: "Instances launched, by result.",
+	}, []string{"app", "result"})
+
+	coldStartDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "launcher_cold_start_duration_seconds",
+		Help:    "Time taken by the backend to launch an instance.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 240, 480, 960},
+	}, []string{"app"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_cache_lookups_total",
+		Help: "Lookups of the cached target, by result.",
+	}, []string{"app", "result"})
+
+	proxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_requests_total",
+		Help: "Requests to the apps, by status code.",
+	}, []string{"app", "code"})
+
+	proxyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "launcher_request_duration_seconds",
+		Help:    "Time taken to answer requests to the apps.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"app"})
+
+	proxyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_proxy_errors_total",
+		Help: "Errors reaching the instance, by what they turned out to be.",
+	}, []string{"app", "type"})
+
+	idleShutdowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_idle_shutdowns_total",
+		Help: "Instances shut down for being idle, by action and result.",
+	}, []string{"app", "action", "result"})
+
+	awsCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "launcher_aws_api_calls_total",
+		Help: "Calls to AWS APIs, by service, operation and result.",
+	}, []string{"service", "operation", "result"})
+)
+
+const (
+	proxyErrorReclaimed   = "reclaimed"
+	proxyErrorGone        = "gone"
+	proxyErrorNotReady    = "not_ready"
+	proxyErrorCheckFailed = "check_failed"
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// countAwsCalls counts the calls made through an AWS session.
+func countAwsCalls(handlers *request.Handlers) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		awsCalls.WithLabelValues(r.ClientInfo.ServiceName, r.Operation.Name, resultLabel(r.Error)).Inc()
+	})
+}
+
+// Metrics counts the requests to the app selected by Route.
+func (r *Router) Metrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			app, ok := c.Get("app").(*App)
+			if !ok {
+				return next(c)
+			}
+
+			start := time.Now()
+			err := next(c)
+
+			code := c.Response().Status
+			if err != nil && !c.Response().Committed {
+				code = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					code = he.Code
+				}
+			}
+			proxyRequests.WithLabelValues(app.Name, strconv.Itoa(code)).Inc()
+			proxyDuration.WithLabelValues(app.Name).Observe(time.Since(start).Seconds())
+
+			return err
+		}
+	}
+}
+
+var (
+	instanceRunningDesc = prometheus.NewDesc("launcher_instance_running",
+		"Whether the launcher knows of a running instance of the app.", []string{"app"}, nil)
+	instanceUptimeDesc = prometheus.NewDesc("launcher_instance_uptime_seconds",
+		"Time since the backend started the instance of the app, or since the launcher found it if the backend does not tell.", []string{"app"}, nil)
+)
+
+// Describe and Collect report the instances of the current apps, which can
+// change on reload.
+func (r *Router) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instanceRunningDesc
+	ch <- instanceUptimeDesc
+}
+
+func (r *Router) Collect(ch chan<- prometheus.Metric) {
+	for _, app := range r.Apps() {
+		running, uptime := 0.0, 0.0
+		if since, ok := app.Launcher.running(); ok {
+			running, uptime = 1, time.Since(since).Seconds()
+		}
+
+		ch <- prometheus.MustNewConstMetric(instanceRunningDesc, prometheus.GaugeValue, running, app.Name)
+		ch <- prometheus.MustNewConstMetric(instanceUptimeDesc, prometheus.GaugeValue, uptime, app.Name)
+	}
+}
+
+func MetricsHandler(router *Router) echo.HandlerFunc {
+	prometheus.MustRegister(router)
+	return echo.WrapHandler(promhttp.Handler())
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	oidcCookieName   = "LAUNCHER_OIDC"
+	oidcFlowTtl      = 10 * time.Minute
+	oidcJwksMinAge   = time.Minute
+	oidcClockSkew    = time.Minute
+	oidcCallbackPath = "/callback"
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcFlow is kept in a cookie between the redirect to the provider and the
+// callback.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+}
+
+type OidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	AuthorizedBy  string          `json:"azp"`
+	Expires       int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+
+	Groups   []string `json:"-"`
+	username string
+}
+
+// OidcProvider talks to an OpenID Connect provider. The discovery document
+// and keys are fetched on first use, so the launcher starts even if the
+// provider is down.
+type OidcProvider struct {
+	config *OidcConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+func NewOidcProvider(config *OidcConfig) *OidcProvider {
+	return &OidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OidcProvider) getJson(u string, out any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p *OidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(p.config.Issuer, "/")
+
+	d := new(oidcDiscovery)
+	if err := p.getJson(issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc discovery document: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery document is for issuer %q, expected %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return nil, errors.New("oidc discovery document is missing endpoints")
+	}
+
+	p.discovery = d
+	return d, nil
+}
+
+// getKey returns the signing key with the given id. Keys are fetched again
+// when an unknown key shows up, as providers rotate them, but not more than
+// once a minute.
+func (p *OidcProvider) getKey(d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysAt) < oidcJwksMinAge {
+		return nil, fmt.Errorf("unknown oidc signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []oidcJwk `json:"keys"`
+	}
+	if err := p.getJson(d.JwksUri, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc signing keys: %w", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysAt = time.Now()
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown oidc signing key %q", kid)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *oidcJwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func (p *OidcProvider) redirectUrl(c echo.Context, authPath string) string {
+	if p.config.RedirectUrl != "" {
+		return p.config.RedirectUrl
+	}
+	return fmt.Sprintf("%s://%s%s%s", c.Scheme(), c.Request().Host, authPath, oidcCallbackPath)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeUrl starts a login and returns the URL of the provider's login
+// page.
+func (p *OidcProvider) AuthCodeUrl(c echo.Context, authPath string, flow *oidcFlow) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientId)
+	q.Set("redirect_uri", p.redirectUrl(c, authPath))
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", flow.State)
+	q.Set("nonce", flow.Nonce)
+	q.Set("code_challenge", pkceChallenge(flow.Verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified claims of
+// the ID token.
+func (p *OidcProvider) Exchange(c echo.Context, authPath string, code string, flow *oidcFlow) (*OidcClaims, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectUrl(c, authPath)},
+		"client_id":     {p.config.ClientId},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem oidc code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("oidc token endpoint returned %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IdToken == "" {
+		return nil, errors.New("oidc token response has no id_token")
+	}
+
+	return p.verifyIdToken(d, tokens.IdToken, flow.Nonce)
+}
+
+func (p *OidcProvider) verifyIdToken(d *oidcDiscovery, token, nonce string) (*OidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+
+	key, err := p.getKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := new(OidcClaims)
+	if err := decodeJwtPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := decodeJwtPart(parts[1], &raw); err != nil {
+		return nil, err
+	}
+	if g, ok := raw[p.config.GroupsClaim]; ok {
+		var group string
+		if json.Unmarshal(g, &group) == nil {
+			claims.Groups = []string{group}
+		} else {
+			_ = json.Unmarshal(g, &claims.Groups)
+		}
+	}
+	if p.config.UsernameClaim != "" {
+		_ = json.Unmarshal(raw[p.config.UsernameClaim], &claims.username)
+		if claims.username == "" {
+			return nil, fmt.Errorf("id token has no %s claim", p.config.UsernameClaim)
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(d.Issuer, "/"):
+		return nil, fmt.Errorf("id token is issued by %q", claims.Issuer)
+	case !claims.hasAudience(p.config.ClientId):
+		return nil, errors.New("id token is not issued for this client")
+	case claims.AuthorizedBy != "" && claims.AuthorizedBy != p.config.ClientId:
+		return nil, errors.New("id token is authorized for another client")
+	case now.After(time.Unix(claims.Expires, 0).Add(oidcClockSkew)):
+		return nil, errors.New("id token is expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("id token is issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+func decodeJwtPart(part string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed id token")
+	}
+	return json.Unmarshal(b, out)
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") && len(sig)%2 == 0 {
+			r := new(big.Int).SetBytes(sig[:len(sig)/2])
+			s := new(big.Int).SetBytes(sig[len(sig)/2:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return errors.New("invalid id token signature")
+		}
+	}
+
+	return fmt.Errorf("id token algorithm %s does not match its key", alg)
+}
+
+func (claims *OidcClaims) hasAudience(clientId string) bool {
+	var aud string
+	if json.Unmarshal(claims.Audience, &aud) == nil {
+		return aud == clientId
+	}
+
+	var auds []string
+	if json.Unmarshal(claims.Audience, &auds) != nil {
+		return false
+	}
+	for _, a := range auds {
+		if a == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// emailVerified reports whether the provider vouches for the email. Emails
+// without email_verified are not trusted, as some providers let users set
+// them freely.
+func (claims *OidcClaims) emailVerified() bool {
+	return claims.Email != "" && claims.EmailVerified != nil && *claims.EmailVerified
+}
+
+// Username is the name the user is known by in the launcher: the configured
+// username claim, the verified email, or else the subject.
+func (claims *OidcClaims) Username() string {
+	if claims.username != "" {
+		return claims.username
+	}
+	if claims.emailVerified() {
+		return claims.Email
+	}
+	return claims.Subject
+}
+
+// Allowed checks the claims against the allowed emails, domains and groups.
+// Anyone the provider authenticates is allowed only with allow_all.
+func (claims *OidcClaims) Allowed(config *OidcConfig) bool {
+	if config.AllowAll {
+		return true
+	}
+
+	if claims.emailVerified() {
+		for _, e := range config.AllowedEmails {
+			if strings.EqualFold(e, claims.Email) {
+				return true
+			}
+		}
+		_, domain, _ := strings.Cut(claims.Email, "@")
+		for _, d := range config.AllowedDomains {
+			if strings.EqualFold(strings.TrimPrefix(d, "@"), domain) {
+				return true
+			}
+		}
+	}
+
+	for _, g := range config.AllowedGroups {
+		for _, cg := range claims.Groups {
+			if g == cg {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *Auth) OidcLogin() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		config := a.getConfig()
+
+		flow := &oidcFlow{Redirect: safeRedirect(c.QueryParam("redirect_uri"))}
+		for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+			var err error
+			if *v, err = newTokenString(); err != nil {
+				return err
+			}
+		}
+
+		u, err := a.getOidc().AuthCodeUrl(c, config.AuthPath, flow)
+		if err != nil {
+			c.Logger().Errorf("Failed to start oidc login: %v", err)
+			return echo.NewHTTPError(http.StatusBadGateway, "The identity provider is not available").SetInternal(err)
+		}
+
+		b, err := json.Marshal(flow)
+		if err != nil {
+			return err
+		}
+		cookie := a.newCookie(c, oidcCookieName, config.AuthPath, base64.RawURLEncoding.EncodeToString(b))
+		cookie.MaxAge = int(oidcFlowTtl / time.Second)
+		// It must be sent on the redirect back from the provider.
+		if cookie.SameSite == http.SameSiteStrictMode {
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+		c.SetCookie(cookie)
+		return c.Redirect(http.StatusFound, u)
+	}
+}
+
+func (a *Auth) OidcCallback() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		config := a.getConfig()
+
+		cookie, err := c.Cookie(oidcCookieName)
+		if err != nil {
+			c.Logger().Debug("Oidc login cookie is not found, starting over")
+			return c.Redirect(http.StatusFound, config.AuthPath)
+		}
+		expired := a.newCookie(c, oidcCookieName, config.AuthPath, "")
+		expired.MaxAge = -1
+		c.SetCookie(expired)
+
+		flow := new(oidcFlow)
+		if err := decodeJwtPart(cookie.Value, flow); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid login state")
+		}
+
+		if e := c.QueryParam("error"); e != "" {
+			c.Logger().Warnf("Oidc login failed: %s %s", e, c.QueryParam("error_description"))
+			return echo.NewHTTPError(http.StatusUnauthorized, "Login failed: "+e)
+		}
+		if !secureEqual(c.QueryParam("state"), flow.State) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid login state")
+		}
+
+		claims, err := a.getOidc().Exchange(c, config.AuthPath, c.QueryParam("code"), flow)
+		if err != nil {
+			c.Logger().Errorf("Oidc login failed: %v", err)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Login failed").SetInternal(err)
+		}
+
+		username := claims.Username()
+		if !claims.Allowed(&config.OidcConfig) {
+			c.Logger().Warnf("User %v is not allowed to log in", username)
+			return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to use this server")
+		}
+
+		c.Logger().Infof("Logged in as %v", username)
+
+		c.Set("Username", username)
+		token, err := a.tokens.NewToken(c, username)
+		if err != nil {
+			return err
+		}
+
+		a.setAuthCookie(c, token)
+		return c.Redirect(http.StatusFound, safeRedirect(flow.Redirect))
+	}
+}
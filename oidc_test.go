@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// mockOidc is an OpenID Connect provider that logs in everyone who is sent to
+// it and issues ID tokens with the claims from the claims function.
+type mockOidc struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	// Set when a user is sent to the authorization endpoint.
+	code, challenge, nonce, redirect string
+
+	claims func(m *mockOidc) map[string]any
+	signer *rsa.PrivateKey
+}
+
+func newMockOidc(t *testing.T) *mockOidc {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockOidc{key: key, signer: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJson(w, http.StatusOK, map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJson(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != "launcher" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		m.code, m.challenge, m.nonce, m.redirect = "code-"+q.Get("state"), q.Get("code_challenge"), q.Get("nonce"), q.Get("redirect_uri")
+		http.Redirect(w, r, m.redirect+"?"+url.Values{"code": {m.code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		switch {
+		case id != "launcher" || secret != "secret":
+			writeTestJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		case r.PostFormValue("code") != m.code || r.PostFormValue("redirect_uri") != m.redirect:
+			writeTestJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		case pkceChallenge(r.PostFormValue("code_verifier")) != m.challenge:
+			writeTestJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		default:
+			writeTestJson(w, http.StatusOK, map[string]string{"id_token": m.idToken(t, m.claims(m))})
+		}
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func writeTestJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (m *mockOidc) idToken(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.signer, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockOidc) validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            m.URL,
+		"sub":            "user-1",
+		"aud":            "launcher",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          m.nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func httpErrorCode(err error) int {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return 0
+}
+
+// oidcRoundTrip logs in through the provider and returns the response to the
+// callback, or its error. Tamper changes the login cookie and callback query
+// before the callback.
+func oidcRoundTrip(t *testing.T, a *Auth, m *mockOidc, tamper func(flow *oidcFlow, q url.Values)) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/.launcher/auth?redirect_uri=/app", nil)
+	rec := httptest.NewRecorder()
+	if err := a.OidcLogin()(e.NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	loginCookie := rec.Result().Cookies()[0]
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization request was rejected with %d", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := callback.Query()
+	if tamper != nil {
+		flow := new(oidcFlow)
+		if err := decodeJwtPart(loginCookie.Value, flow); err != nil {
+			t.Fatal(err)
+		}
+		tamper(flow, q)
+		b, _ := json.Marshal(flow)
+		loginCookie.Value = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, callback.Path+"?"+q.Encode(), nil)
+	req.AddCookie(loginCookie)
+	rec = httptest.NewRecorder()
+	return rec, a.OidcCallback()(e.NewContext(req, rec))
+}
+
+func newTestOidcAuth(t *testing.T, m *mockOidc) *Auth {
+	a, _ := newTestAuth(t, fmt.Sprintf(`  enable: true
+  mode: oidc
+  oidc:
+    issuer: %s
+    client_id: launcher
+    client_secret: secret
+    allowed_emails: [alice@example.com]
+    allowed_groups: [gpu]
+`, m.URL))
+	return a
+}
+
+func TestOidcLogin(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		claims   func(c map[string]any)
+		signer   *rsa.PrivateKey
+		tamper   func(flow *oidcFlow, q url.Values)
+		code     int
+		username string
+	}{
+		{name: "valid", username: "alice@example.com"},
+		{name: "audience list", claims: func(c map[string]any) { c["aud"] = []string{"other", "launcher"} }, username: "alice@example.com"},
+		{name: "allowed group with unverified email", claims: func(c map[string]any) {
+			c["email_verified"] = false
+			c["groups"] = []string{"gpu"}
+		}, username: "user-1"},
+		{name: "bad signature", signer: other, code: http.StatusUnauthorized},
+		{name: "other issuer", claims: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, code: http.StatusUnauthorized},
+		{name: "other audience", claims: func(c map[string]any) { c["aud"] = "other" }, code: http.StatusUnauthorized},
+		{name: "other authorized party", claims: func(c map[string]any) { c["azp"] = "other" }, code: http.StatusUnauthorized},
+		{name: "expired", claims: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, code: http.StatusUnauthorized},
+		{name: "issued in the future", claims: func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }, code: http.StatusUnauthorized},
+		{name: "other nonce", claims: func(c map[string]any) { c["nonce"] = "other" }, code: http.StatusUnauthorized},
+		{name: "unverified email", claims: func(c map[string]any) { c["email_verified"] = false }, code: http.StatusForbidden},
+		{name: "email without verification", claims: func(c map[string]any) { delete(c, "email_verified") }, code: http.StatusForbidden},
+		{name: "not allowed", claims: func(c map[string]any) { c["email"] = "mallory@example.com" }, code: http.StatusForbidden},
+		{name: "other state", tamper: func(flow *oidcFlow, q url.Values) { q.Set("state", "other") }, code: http.StatusBadRequest},
+		{name: "other verifier", tamper: func(flow *oidcFlow, q url.Values) { flow.Verifier = "other" }, code: http.StatusUnauthorized},
+		{name: "provider error", tamper: func(flow *oidcFlow, q url.Values) { q.Set("error", "access_denied") }, code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockOidc(t)
+			m.claims = func(m *mockOidc) map[string]any {
+				c := m.validClaims()
+				if tt.claims != nil {
+					tt.claims(c)
+				}
+				return c
+			}
+			if tt.signer != nil {
+				m.signer = tt.signer
+			}
+			a := newTestOidcAuth(t, m)
+
+			rec, err := oidcRoundTrip(t, a, m, tt.tamper)
+			if tt.code != 0 {
+				if code := httpErrorCode(err); code != tt.code {
+					t.Fatalf("got error %v, want status %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if loc := rec.Header().Get(echo.HeaderLocation); rec.Code != http.StatusFound || loc != "/app" {
+				t.Fatalf("got %d to %q, want a redirect to /app", rec.Code, loc)
+			}
+			var token string
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == authCookieName {
+					token = cookie.Value
+				}
+			}
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+			sess, err := a.tokens.Verify(c, token)
+			if err != nil || sess == nil {
+				t.Fatalf("no session for the auth cookie: %v", err)
+			}
+			if sess.Username != tt.username {
+				t.Fatalf("logged in as %q, want %q", sess.Username, tt.username)
+			}
+		})
+	}
+}
+
+func TestOidcUsernameClaim(t *testing.T) {
+	m := newMockOidc(t)
+	a, _ := newTestAuth(t, fmt.Sprintf(`  enable: true
+  mode: oidc
+  oidc:
+    issuer: %s
+    client_id: launcher
+    client_secret: secret
+    username_claim: preferred_username
+    allow_all: true
+`, m.URL))
+
+	m.claims = func(m *mockOidc) map[string]any {
+		c := m.validClaims()
+		c["preferred_username"] = "alice"
+		return c
+	}
+	if _, err := oidcRoundTrip(t, a, m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m.claims = func(m *mockOidc) map[string]any { return m.validClaims() }
+	if _, err := oidcRoundTrip(t, a, m, nil); httpErrorCode(err) != http.StatusUnauthorized {
+		t.Fatalf("got error %v for a token without the username claim", err)
+	}
+}
+
+func TestOidcConfigNeedsAllowList(t *testing.T) {
+	config := loadTestConfig(t, "  enable: false\n")
+	config.AuthConfig.EnableAuth = true
+	config.AuthConfig.Mode = AuthModeOidc
+	config.AuthConfig.OidcConfig.Issuer = "https://accounts.example.com"
+	config.AuthConfig.OidcConfig.ClientId = "launcher"
+	if err := config.Validate(); err == nil {
+		t.Fatal("oidc without an allow list or allow_all was accepted")
+	}
+
+	config.AuthConfig.OidcConfig.AllowAll = true
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
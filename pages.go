@@ -3,6 +3,7 @@ package main
 import (
 	"html/template"
 	"io"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -22,15 +23,25 @@ func (t *Template) Render(w io.Writer, name string, data any, c echo.Context) er
 func NewPageRenderer() *Template {
 	return &Template{
 		templates: map[string]*template.Template{
-			"AuthTemplate":    template.Must(template.New("AuthTemplate").Parse(loginPageTplSrc)),
-			"RefreshTemplate": template.Must(template.New("RefreshTemplate").Parse(refreshPageTmpSrc)),
+			"AuthTemplate":      template.Must(template.New("AuthTemplate").Parse(loginPageTplSrc)),
+			"RefreshTemplate":   template.Must(template.New("RefreshTemplate").Parse(refreshPageTmpSrc)),
+			"SessionsTemplate":  template.Must(template.New("SessionsTemplate").Parse(sessionsPageTplSrc)),
+			"LogoutTemplate":    template.Must(template.New("LogoutTemplate").Parse(logoutPageTplSrc)),
+			"DashboardTemplate": template.Must(template.New("DashboardTemplate").Parse(dashboardPageTplSrc)),
 		},
 	}
 }
 
+type LoginPageParams struct {
+	Path  string
+	Csrf  string
+	Error string
+}
+
 type RefreshPageParams struct {
 	Title   string
 	Message string
+	Detail  string
 	Emoji   string
 	Seconds int
 }
@@ -104,6 +115,11 @@ const loginPageTplSrc = `
             font-weight: bold;
         }
 
+        .error {
+            color: #e53935;
+            text-align: center;
+        }
+
         input[type="submit"]:hover {
             background-color: darken(var(--button-background-color), 10%);
         }
@@ -127,7 +143,11 @@ const loginPageTplSrc = `
 <body>
     <div class="container">
         <h2>Login</h2>
+        {{if .Error}}
+        <p class="error">{{.Error}}</p>
+        {{end}}
         <form action="{{.Path}}" method="POST">
+            <input type="hidden" name="csrf_token" value="{{.Csrf}}">
             <input type="text" name="username" placeholder="Username" required>
             <input type="password" name="password" placeholder="Password" required>
             <input type="submit" value="Login">
@@ -188,6 +208,11 @@ const refreshPageTmpSrc = `
       margin-top: 20px;
     }
 
+    .detail {
+      font-size: 14px;
+      opacity: 0.7;
+    }
+
     .emoji {
       font-size: 50px;
       margin-top: 50px;
@@ -216,6 +241,7 @@ const refreshPageTmpSrc = `
 <body>
   <h1>{{.Title}}</h1>
   <p>{{.Message}}</p>
+  {{if .Detail}}<p class="detail">{{.Detail}}</p>{{end}}
   <div class="emoji">{{.Emoji}}</div>
   <p id="timer">Refreshing in <span id="countdown">11</span> seconds...</p>
 
@@ -250,3 +276,456 @@ const refreshPageTmpSrc = `
 </body>
 </html>
 `
+
+type LogoutPageParams struct {
+	LoginPath string
+	// Revoked is false if copies of the cookie stay valid until they expire.
+	Revoked bool
+	Expires time.Time
+	// Confirm asks to log out with a form, as logging out takes a POST with
+	// a csrf token.
+	Confirm bool
+	Path    string
+	Csrf    string
+}
+
+const logoutPageTplSrc = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{if .Confirm}}Log out{{else}}Logged out{{end}}</title>
+    <style>
+        :root {
+            --background-color: #f2f2f2;
+            --text-color: #000;
+            --input-background-color: #fff;
+            --link-color: #4caf50;
+            --button-background-color: #4caf50;
+            --button-text-color: #fff;
+        }
+
+        @media (prefers-color-scheme: dark) {
+            :root {
+                --background-color: #333;
+                --text-color: #fff;
+                --input-background-color: #444;
+                --link-color: #6abf69;
+                --button-background-color: #6abf69;
+                --button-text-color: #000;
+            }
+        }
+
+        body {
+            font-family: Arial, sans-serif;
+            background-color: var(--background-color);
+            color: var(--text-color);
+        }
+
+        .container {
+            max-width: 400px;
+            margin: 0 auto;
+            padding: 40px;
+            background-color: var(--input-background-color);
+            border-radius: 5px;
+            box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
+            text-align: center;
+        }
+
+        a {
+            color: var(--link-color);
+        }
+
+        input[type="submit"] {
+            width: 100%;
+            padding: 10px;
+            background-color: var(--button-background-color);
+            color: var(--button-text-color);
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+            font-weight: bold;
+        }
+    </style>
+</head>
+
+<body>
+    <div class="container">
+        {{if .Confirm}}
+        <h2>Log out</h2>
+        <form action="{{.Path}}" method="POST">
+            <input type="hidden" name="csrf_token" value="{{.Csrf}}">
+            <input type="submit" value="Log out">
+        </form>
+        {{else}}
+        <h2>Logged out</h2>
+        {{if .Revoked}}
+        <p>Your session has ended.</p>
+        {{else}}
+        <p>The session cookie is removed from this browser. Sessions are kept in
+            signed cookies and can't be ended on the server, so a copy of the
+            cookie stays valid until {{if .Expires.IsZero}}it expires{{else}}{{.Expires.Format "2006-01-02 15:04:05 MST"}}{{end}}.</p>
+        {{end}}
+        <p><a href="{{.LoginPath}}">Log in again</a></p>
+        {{end}}
+    </div>
+</body>
+
+</html>
+`
+
+const sessionsPageTplSrc = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sessions</title>
+    <style>
+        :root {
+            --background-color: #f2f2f2;
+            --text-color: #000;
+            --input-background-color: #fff;
+            --border-color: #ddd;
+            --button-background-color: #4caf50;
+            --button-text-color: #fff;
+        }
+
+        @media (prefers-color-scheme: dark) {
+            :root {
+                --background-color: #333;
+                --text-color: #fff;
+                --input-background-color: #444;
+                --border-color: #555;
+                --button-background-color: #6abf69;
+                --button-text-color: #000;
+            }
+        }
+
+        body {
+            font-family: Arial, sans-serif;
+            background-color: var(--background-color);
+            color: var(--text-color);
+        }
+
+        .container {
+            max-width: 1000px;
+            margin: 0 auto;
+            padding: 40px;
+            background-color: var(--input-background-color);
+            border-radius: 5px;
+            box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
+            overflow-x: auto;
+        }
+
+        h2 {
+            text-align: center;
+            margin-bottom: 30px;
+        }
+
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+
+        th,
+        td {
+            padding: 8px;
+            text-align: left;
+            border-bottom: 1px solid var(--border-color);
+        }
+
+        td.agent {
+            max-width: 300px;
+            overflow: hidden;
+            text-overflow: ellipsis;
+            white-space: nowrap;
+        }
+
+        form {
+            display: inline;
+        }
+
+        input[type="submit"] {
+            padding: 6px 10px;
+            background-color: var(--button-background-color);
+            color: var(--button-text-color);
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+            font-weight: bold;
+        }
+    </style>
+</head>
+
+<body>
+    <div class="container">
+        <h2>Sessions</h2>
+        {{if .Error}}
+        <p>{{.Error}}</p>
+        {{else}}
+        <table>
+            <tr>
+                <th>User</th>
+                <th>Created</th>
+                <th>Last seen</th>
+                <th>Client IP</th>
+                <th>User agent</th>
+                <th></th>
+            </tr>
+            {{range .Sessions}}
+            <tr>
+                <td>{{.Username}}{{if eq .Id $.Current}} (you){{end}}</td>
+                <td>{{.Created.Format "2006-01-02 15:04:05"}}</td>
+                <td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td>
+                <td>{{.ClientIp}}</td>
+                <td class="agent" title="{{.UserAgent}}">{{.UserAgent}}</td>
+                <td>
+                    <form action="{{$.Path}}/revoke" method="POST">
+                        <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                        <input type="hidden" name="id" value="{{.Id}}">
+                        <input type="submit" value="Revoke">
+                    </form>
+                    <form action="{{$.Path}}/revoke" method="POST">
+                        <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                        <input type="hidden" name="username" value="{{.Username}}">
+                        <input type="submit" value="Revoke all of user">
+                    </form>
+                </td>
+            </tr>
+            {{else}}
+            <tr>
+                <td colspan="6">No active sessions.</td>
+            </tr>
+            {{end}}
+        </table>
+        {{end}}
+    </div>
+</body>
+
+</html>
+`
+
+const dashboardPageTplSrc = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Launcher</title>
+    <style>
+        :root {
+            --background-color: #f2f2f2;
+            --text-color: #000;
+            --muted-text-color: #666;
+            --input-background-color: #fff;
+            --border-color: #ddd;
+            --button-background-color: #4caf50;
+            --button-text-color: #fff;
+            --danger-color: #e53935;
+        }
+
+        @media (prefers-color-scheme: dark) {
+            :root {
+                --background-color: #333;
+                --text-color: #fff;
+                --muted-text-color: #aaa;
+                --input-background-color: #444;
+                --border-color: #555;
+                --button-background-color: #6abf69;
+                --button-text-color: #000;
+                --danger-color: #ef5350;
+            }
+        }
+
+        body {
+            font-family: Arial, sans-serif;
+            background-color: var(--background-color);
+            color: var(--text-color);
+        }
+
+        .container {
+            max-width: 1000px;
+            margin: 0 auto;
+            padding: 40px;
+        }
+
+        h2 {
+            text-align: center;
+            margin-bottom: 30px;
+        }
+
+        .app {
+            margin-bottom: 20px;
+            padding: 20px 30px;
+            background-color: var(--input-background-color);
+            border-radius: 5px;
+            box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
+        }
+
+        .error {
+            color: var(--danger-color);
+            text-align: center;
+        }
+
+        .muted {
+            color: var(--muted-text-color);
+        }
+
+        dl {
+            display: grid;
+            grid-template-columns: max-content auto;
+            gap: 6px 20px;
+        }
+
+        dt {
+            font-weight: bold;
+        }
+
+        dd {
+            margin: 0;
+        }
+
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+
+        th,
+        td {
+            padding: 6px;
+            text-align: left;
+            border-bottom: 1px solid var(--border-color);
+        }
+
+        form {
+            display: inline;
+        }
+
+        select,
+        input[type="submit"] {
+            padding: 6px 10px;
+            border-radius: 4px;
+        }
+
+        input[type="submit"] {
+            background-color: var(--button-background-color);
+            color: var(--button-text-color);
+            border: none;
+            cursor: pointer;
+            font-weight: bold;
+        }
+
+        input[type="submit"].danger {
+            background-color: var(--danger-color);
+        }
+    </style>
+</head>
+
+<body>
+    <div class="container">
+        <h2>Launcher</h2>
+        {{if .Error}}
+        <p class="error">{{.Error}}</p>
+        {{end}}
+        {{range .Apps}}
+        <div class="app">
+            <h3>{{.Name}} <span class="muted">{{.Backend}}</span></h3>
+            <dl>
+                <dt>State</dt>
+                <dd>{{.State}}</dd>
+                {{if .Running}}
+                <dt>Instance</dt>
+                <dd>{{.Url}}{{if .Description}} <span class="muted">{{.Description}}</span>{{end}}</dd>
+                {{if .Uptime}}
+                <dt>Uptime</dt>
+                <dd>{{.Uptime}}</dd>
+                {{end}}
+                {{if .Cost}}
+                <dt>Estimated cost</dt>
+                <dd>{{.Cost}}</dd>
+                {{end}}
+                {{if .ShutdownSeconds}}
+                <dt>Idle shutdown in</dt>
+                <dd class="countdown" data-seconds="{{.ShutdownSeconds}}"></dd>
+                {{end}}
+                {{end}}
+            </dl>
+            <p>
+                {{$name := .Name}}
+                {{if .Running}}
+                <form action="{{$.Path}}/apps/{{$name}}/extend" method="POST">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <select name="duration">
+                        <option value="30m">30 minutes</option>
+                        <option value="1h">1 hour</option>
+                        <option value="4h">4 hours</option>
+                    </select>
+                    <input type="submit" value="Extend">
+                </form>
+                <form action="{{$.Path}}/apps/{{$name}}/restart" method="POST">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <input type="submit" value="Restart">
+                </form>
+                <form action="{{$.Path}}/apps/{{$name}}/stop" method="POST">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <input type="submit" class="danger" value="Stop">
+                </form>
+                <form action="{{$.Path}}/apps/{{$name}}/terminate" method="POST"
+                    onsubmit="return confirm('Terminate the instance of {{$name}}?')">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <input type="submit" class="danger" value="Terminate">
+                </form>
+                {{else}}
+                <form action="{{$.Path}}/apps/{{$name}}/launch" method="POST">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <input type="submit" value="Launch">
+                </form>
+                {{end}}
+                <form action="{{$.Path}}/apps/{{$name}}/flush" method="POST">
+                    <input type="hidden" name="csrf_token" value="{{$.Csrf}}">
+                    <input type="submit" value="Flush cache">
+                </form>
+            </p>
+            {{if .Launches}}
+            <h4>Recent launches</h4>
+            <table>
+                <tr>
+                    <th>Time</th>
+                    <th>Instance</th>
+                    <th>User</th>
+                </tr>
+                {{range .Launches}}
+                <tr>
+                    <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+                    <td>{{.Url}}{{if .Description}} <span class="muted">{{.Description}}</span>{{end}}</td>
+                    <td>{{.Username}}</td>
+                </tr>
+                {{end}}
+            </table>
+            {{end}}
+        </div>
+        {{end}}
+        <p class="muted">Logged in as {{.Username}}.</p>
+    </div>
+    <script>
+        var countdowns = document.querySelectorAll(".countdown");
+
+        function updateCountdowns() {
+            countdowns.forEach(function (el) {
+                var s = Math.max(0, parseInt(el.dataset.seconds));
+                var h = Math.floor(s / 3600);
+                var m = Math.floor(s % 3600 / 60);
+                el.textContent = (h > 0 ? h + "h " : "") + m + "m " + s % 60 + "s";
+                el.dataset.seconds = s - 1;
+            });
+        }
+
+        updateCountdowns();
+        setInterval(updateCountdowns, 1000);
+    </script>
+</body>
+
+</html>
+`
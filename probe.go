@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
+)
+
+type Prober struct {
+	config *ProbeConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	current *probe
+}
+
+type probe struct {
+	url  url.URL
+	stop chan struct{}
+	poke chan struct{}
+
+	mu        sync.Mutex
+	ready     bool
+	lastErr   error
+	nextProbe time.Time
+}
+
+func NewProberFromConfig(c *AppConfig) *Prober {
+	if !c.ProbeConfig.Enabled {
+		return nil
+	}
+
+	return &Prober{
+		config: &c.ProbeConfig,
+		client: &http.Client{
+			Timeout: c.ProbeConfig.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (p *Prober) Watch(logger echo.Logger, t *Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current != nil && p.current.url == *t.URL {
+		return
+	}
+
+	if p.current != nil {
+		close(p.current.stop)
+	}
+
+	p.current = &probe{
+		url:       *t.URL,
+		stop:      make(chan struct{}),
+		poke:      make(chan struct{}, 1),
+		nextProbe: time.Now(),
+	}
+
+	go p.run(logger, p.current)
+}
+
+func (p *Prober) Forget(t *Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current != nil && p.current.url == *t.URL {
+		close(p.current.stop)
+		p.current = nil
+	}
+}
+
+func (p *Prober) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current != nil {
+		close(p.current.stop)
+		p.current = nil
+	}
+}
+
+func (p *Prober) get(t *Target) *probe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil || p.current.url != *t.URL {
+		return nil
+	}
+	return p.current
+}
+
+func (p *Prober) Ready(t *Target) bool {
+	pr := p.get(t)
+	if pr == nil {
+		return false
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	return pr.ready
+}
+
+// Reset marks the target as not ready and probes it again right away, used
+// when the proxy fails to reach a target that was considered ready.
+func (p *Prober) Reset(t *Target) {
+	pr := p.get(t)
+	if pr == nil {
+		return
+	}
+
+	pr.mu.Lock()
+	pr.ready = false
+	pr.mu.Unlock()
+
+	select {
+	case pr.poke <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Prober) RetryAfter(t *Target) time.Duration {
+	wait := p.config.Interval
+
+	if pr := p.get(t); pr != nil {
+		pr.mu.Lock()
+		wait = time.Until(pr.nextProbe)
+		pr.mu.Unlock()
+	}
+
+	wait = wait.Truncate(time.Second) + 2*time.Second
+	if wait < 0 {
+		wait = 2 * time.Second
+	}
+	return wait
+}
+
+func (p *Prober) run(logger echo.Logger, pr *probe) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-pr.stop:
+			return
+		case <-pr.poke:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+
+		err := p.check(&pr.url)
+
+		pr.mu.Lock()
+		if pr.ready != (err == nil) {
+			fields := elog.JSON{"url": pr.url.String(), "ready": err == nil}
+			if err != nil {
+				fields["error"] = err
+			}
+			logEvent(logger, elog.INFO, "instance.probe", fields)
+		}
+		pr.ready = err == nil
+		pr.lastErr = err
+		pr.nextProbe = time.Now().Add(p.config.Interval)
+		pr.mu.Unlock()
+
+		timer.Reset(p.config.Interval)
+	}
+}
+
+func (p *Prober) check(u *url.URL) error {
+	if p.config.Path == "" {
+		return p.checkTcp(u)
+	}
+
+	target := *u
+	target.Path = p.config.Path
+
+	resp, err := p.client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if len(p.config.Status) == 0 {
+		if resp.StatusCode < http.StatusBadRequest {
+			return nil
+		}
+	}
+	for _, s := range p.config.Status {
+		if resp.StatusCode == s {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+func (p *Prober) checkTcp(u *url.URL) error {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, p.config.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -2,28 +2,52 @@ package main
 
 import (
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func Proxy(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		target, ok := ctx.Get("target").(*Target)
+// stripPrefixRewrite builds the rewrite that strips prefix from the path of
+// proxied requests, once for all requests.
+func stripPrefixRewrite(prefix string) map[*regexp.Regexp]string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return nil
+	}
+	return map[*regexp.Regexp]string{
+		regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "/?(.*)$"): "/$1",
+	}
+}
 
-		if !ok {
-			return echo.NewHTTPError(http.StatusInternalServerError, "proxy target not set")
-		}
+func Proxy(activity *Activity, rewrite map[*regexp.Regexp]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			target, ok := ctx.Get("target").(*Target)
 
-		ctx.Logger().Debugf("proxy to address %s", target.URL.Host)
-		targets := []*middleware.ProxyTarget{
-			{
-				URL: target.URL,
-			},
-		}
+			if !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError, "proxy target not set")
+			}
 
-		proxyFunc := middleware.Proxy(middleware.NewRoundRobinBalancer(targets))
+			done := activity.Begin(target)
+			defer done()
 
-		return proxyFunc(next)(ctx)
+			ctx.Logger().Debugf("proxy to address %s", target.URL.Host)
+			targets := []*middleware.ProxyTarget{
+				{
+					URL: target.URL,
+				},
+			}
+
+			proxyConfig := middleware.ProxyConfig{
+				Balancer:     middleware.NewRoundRobinBalancer(targets),
+				RegexRewrite: rewrite,
+			}
+
+			proxyFunc := middleware.ProxyWithConfig(proxyConfig)
+
+			return proxyFunc(next)(ctx)
+		}
 	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestProxyStripPrefix(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		prefix, path, want string
+	}{
+		{"", "/app/page", "/app/page"},
+		{"/", "/app/page", "/app/page"},
+		{"/app", "/app", "/"},
+		{"/app", "/app/", "/"},
+		{"/app", "/app/page?q=1", "/page?q=1"},
+		{"/app/", "/app", "/"},
+		{"/app/", "/app/page", "/page"},
+		{"/a.b", "/a.b/page", "/page"},
+	}
+	for _, tt := range tests {
+		got = ""
+		h := Proxy(NewActivity(), stripPrefixRewrite(tt.prefix))(func(c echo.Context) error {
+			return nil
+		})
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.path, nil), httptest.NewRecorder())
+		c.Set("target", &Target{URL: u})
+		if err := h(c); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("prefix %q: %s was proxied as %s, want %s", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Settings that are only read on startup. Changes to them are logged but need
+// a restart to take effect.
+var restartOnlySettings = map[string]bool{
+	"port":           true,
+	"host":           true,
+	"api_path":       true,
+	"dashboard_path": true,
+	"metrics_path":   true,
+	"watch_interval": true,
+	"auth.enable":    true,
+	"auth.path":      true,
+	"auth.mode":      true,
+
+	"auth.token_store":            true,
+	"auth.token_file":             true,
+	"auth.redis_url":              true,
+	"auth.token_cleanup_interval": true,
+	"auth.cookie_keys":            true,
+	"auth.trusted_proxies":        true,
+	"auth.cookie_secure":          true,
+	"auth.cookie_same_site":       true,
+}
+
+type ReloadFunc func(c echo.Context, config *Config)
+
+// Reloader reloads the config when its file changes or on SIGHUP, and hands
+// valid configs to the registered functions.
+type Reloader struct {
+	c echo.Context
+
+	mu      sync.Mutex
+	config  *Config
+	modTime time.Time
+	funcs   []ReloadFunc
+}
+
+func NewReloader(c echo.Context, config *Config) *Reloader {
+	r := &Reloader{
+		c:      c,
+		config: config,
+	}
+	r.modTime, _ = r.stat()
+	return r
+}
+
+func (r *Reloader) OnReload(f ReloadFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.funcs = append(r.funcs, f)
+}
+
+func (r *Reloader) stat() (time.Time, error) {
+	if r.config.File == "" {
+		return time.Time{}, nil
+	}
+
+	fi, err := os.Stat(r.config.File)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (r *Reloader) Run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var poll <-chan time.Time
+	if r.config.File != "" && r.config.WatchInterval > 0 {
+		ticker := time.NewTicker(r.config.WatchInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			r.c.Logger().Info("Got SIGHUP, reloading config")
+			r.Reload()
+		case <-poll:
+			modTime, err := r.stat()
+			if err != nil {
+				r.c.Logger().Errorf("Failed to check config file: %v", err)
+				continue
+			}
+			if !modTime.Equal(r.modTime) {
+				r.c.Logger().Infof("Config file %s changed, reloading config", r.config.File)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// Reload loads the config again. An invalid config is rejected and the
+// current one stays in effect.
+func (r *Reloader) Reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, _ := r.stat()
+	r.modTime = modTime
+
+	config, err := LoadConfig(r.config.File)
+	if err != nil {
+		r.c.Logger().Errorf("Rejected new config, keeping the current one: %v", err)
+		return
+	}
+
+	changes := diffConfig(r.config, &config)
+	if len(changes) == 0 {
+		r.c.Logger().Info("Config is unchanged")
+		return
+	}
+
+	for _, change := range changes {
+		if restartOnlySettings[change.Path] {
+			r.c.Logger().Warnf("Config changed: %v (takes effect after a restart)", change)
+		} else {
+			r.c.Logger().Infof("Config changed: %v", change)
+		}
+	}
+
+	r.config = &config
+	for _, f := range r.funcs {
+		f(r.c, r.config)
+	}
+}
+
+type configChange struct {
+	Path     string
+	Old, New any
+	Redact   bool
+}
+
+func (cc configChange) String() string {
+	switch {
+	case cc.Old == nil:
+		return fmt.Sprintf("%s added", cc.Path)
+	case cc.New == nil:
+		return fmt.Sprintf("%s removed", cc.Path)
+	case cc.Redact:
+		return fmt.Sprintf("%s changed", cc.Path)
+	default:
+		return fmt.Sprintf("%s: %v -> %v", cc.Path, formatConfigValue(cc.Old), formatConfigValue(cc.New))
+	}
+}
+
+func formatConfigValue(v any) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+// diffConfig lists the settings that differ between two configs, named after
+// their keys in the config file. Apps are compared by name.
+func diffConfig(old, new *Config) []configChange {
+	var changes []configChange
+
+	diffFields("", reflect.ValueOf(*old), reflect.ValueOf(*new), false, &changes)
+
+	oldApps := make(map[string]*AppConfig, len(old.Apps))
+	for i := range old.Apps {
+		oldApps[old.Apps[i].Name] = &old.Apps[i]
+	}
+
+	for i := range new.Apps {
+		ac := &new.Apps[i]
+		path := "apps." + ac.Name
+
+		prev, ok := oldApps[ac.Name]
+		if !ok {
+			changes = append(changes, configChange{Path: path, New: ac.Name})
+			continue
+		}
+		delete(oldApps, ac.Name)
+
+		diffFields(path+".", reflect.ValueOf(*prev), reflect.ValueOf(*ac), false, &changes)
+	}
+
+	for name := range oldApps {
+		changes = append(changes, configChange{Path: "apps." + name, Old: name})
+	}
+
+	return changes
+}
+
+func diffFields(prefix string, old, new reflect.Value, redact bool, changes *[]configChange) {
+	if old.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(old.Interface(), new.Interface()) {
+			*changes = append(*changes, configChange{
+				Path:   strings.TrimSuffix(prefix, "."),
+				Old:    old.Interface(),
+				New:    new.Interface(),
+				Redact: redact,
+			})
+		}
+		return
+	}
+
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		// Skip fields that are not settings, and the app defaults which are
+		// compared per app instead.
+		if name == "-" || opts == "inline" {
+			continue
+		}
+
+		diffFields(prefix+name+".", old.Field(i), new.Field(i), field.Tag.Get("redact") == "true", changes)
+	}
+}
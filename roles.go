@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Role tells what a user may do. Each role can do everything the roles before
+// it can.
+type Role int
+
+const (
+	// RoleViewer can use an instance that is already running.
+	RoleViewer Role = iota
+	// RoleOperator can also launch instances.
+	RoleOperator
+	// RoleAdmin can also use the management endpoints.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+func ParseRole(s string) (Role, error) {
+	for _, r := range []Role{RoleViewer, RoleOperator, RoleAdmin} {
+		if s == r.String() {
+			return r, nil
+		}
+	}
+	return RoleViewer, fmt.Errorf("must be viewer, operator or admin, got %q", s)
+}
+
+// roleOf returns the role of the authenticated user. Everyone is an admin
+// when auth is disabled.
+func roleOf(c echo.Context) Role {
+	if r, ok := c.Get("Role").(Role); ok {
+		return r
+	}
+	return RoleAdmin
+}
+
+// Role returns the highest role the user is listed with, or the default role.
+// Usernames are matched regardless of case. The user set by username is
+// always an admin when logged in with its password, but not when another user
+// of the oidc provider or proxy has the same name.
+func (a *Auth) Role(username string, password bool) Role {
+	config := a.getConfig()
+	if password && config.Username != "" && strings.EqualFold(username, config.Username) {
+		return RoleAdmin
+	}
+
+	lists := []struct {
+		role  Role
+		names []string
+	}{
+		{RoleAdmin, config.Admins},
+		{RoleOperator, config.Operators},
+		{RoleViewer, config.Viewers},
+	}
+	for _, l := range lists {
+		for _, name := range l.names {
+			if strings.EqualFold(username, name) {
+				return l.role
+			}
+		}
+	}
+
+	r, _ := ParseRole(config.DefaultRole)
+	return r
+}
+
+// RequireRole only lets users with at least the role through. It runs after
+// Authenticate.
+func RequireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if roleOf(c) < role {
+				c.Logger().Warnf("User %v needs the %v role", c.Get("Username"), role)
+				return echo.ErrForbidden
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireAuth reserves the paths of a group that only makes sense with auth,
+// such as the API, so that they are not proxied to the app when auth is
+// disabled.
+func RequireAuth(name string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("The %s needs auth to be enabled", name))
+		}
+	}
+}
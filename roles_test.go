@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRole(t *testing.T) {
+	a, _ := newTestAuth(t, `  enable: true
+  username: esh
+  password: hunter2secret
+  default_role: viewer
+  admins: [Alice]
+  operators: [bob, alice]
+  viewers: [carol]
+`)
+
+	tests := []struct {
+		username string
+		password bool
+		role     Role
+	}{
+		{"esh", true, RoleAdmin},
+		{"ESH", true, RoleAdmin},
+		{"esh", false, RoleViewer},
+		{"alice", false, RoleAdmin},
+		{"ALICE", true, RoleAdmin},
+		{"Bob", false, RoleOperator},
+		{"carol", false, RoleViewer},
+		{"dave", true, RoleViewer},
+		{"", false, RoleViewer},
+	}
+	for _, tt := range tests {
+		if got := a.Role(tt.username, tt.password); got != tt.role {
+			t.Errorf("Role(%q, %v) = %v, want %v", tt.username, tt.password, got, tt.role)
+		}
+	}
+}
+
+func TestRoleByAuthMethod(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  string
+		setup func(a *Auth, req *http.Request)
+		role  Role
+	}{
+		{
+			name: "form login",
+			auth: "  mode: form\n",
+			setup: func(a *Auth, req *http.Request) {
+				token, _ := a.tokens.NewToken(testContext(), "esh")
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
+			},
+			role: RoleAdmin,
+		},
+		{
+			name: "basic auth",
+			auth: "  mode: form\n  basic: true\n",
+			setup: func(a *Auth, req *http.Request) {
+				req.SetBasicAuth("esh", "hunter2secret")
+			},
+			role: RoleAdmin,
+		},
+		{
+			name: "oidc login",
+			auth: "  mode: oidc\n  oidc:\n    issuer: https://accounts.example.com\n    client_id: launcher\n    allow_all: true\n",
+			setup: func(a *Auth, req *http.Request) {
+				token, _ := a.tokens.NewToken(testContext(), "esh")
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
+			},
+			role: RoleOperator,
+		},
+		{
+			name: "trusted header",
+			auth: "  mode: header\n  trusted_proxies: [192.0.2.0/24]\n",
+			setup: func(a *Auth, req *http.Request) {
+				req.Header.Set("X-Forwarded-User", "esh")
+			},
+			role: RoleOperator,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAuth(t, "  enable: true\n  username: esh\n  password: hunter2secret\n"+tt.auth)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.setup(a, req)
+
+			var role Role = -1
+			h := a.Authenticate()(func(c echo.Context) error {
+				role = roleOf(c)
+				return nil
+			})
+			if err := h(echo.New().NewContext(req, httptest.NewRecorder())); err != nil {
+				t.Fatal(err)
+			}
+			if role != tt.role {
+				t.Fatalf("got role %v, want %v", role, tt.role)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    any
+		require Role
+		allowed bool
+	}{
+		{"auth disabled", nil, RoleAdmin, true},
+		{"viewer for viewer", RoleViewer, RoleViewer, true},
+		{"viewer for operator", RoleViewer, RoleOperator, false},
+		{"operator for operator", RoleOperator, RoleOperator, true},
+		{"operator for admin", RoleOperator, RoleAdmin, false},
+		{"admin for admin", RoleAdmin, RoleAdmin, true},
+		{"admin for viewer", RoleAdmin, RoleViewer, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testContext()
+			if tt.role != nil {
+				c.Set("Role", tt.role)
+			}
+
+			called := false
+			err := RequireRole(tt.require)(func(c echo.Context) error {
+				called = true
+				return nil
+			})(c)
+			if called != tt.allowed {
+				t.Fatalf("handler called %v, want %v", called, tt.allowed)
+			}
+			if !tt.allowed && err != echo.ErrForbidden {
+				t.Fatalf("got error %v, want forbidden", err)
+			}
+		})
+	}
+}
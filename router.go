@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type App struct {
+	Name     string
+	Hosts    []string
+	Prefix   string
+	Launcher *Launcher
+}
+
+func (a *App) matchHost(host string) bool {
+	for _, h := range a.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(strings.ToLower(host), strings.ToLower(h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) matchPath(path string) bool {
+	if a.Prefix == "" || a.Prefix == "/" {
+		return true
+	}
+	prefix := strings.TrimSuffix(a.Prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+type Router struct {
+	mu   sync.RWMutex
+	apps []*App
+}
+
+func NewRouterFromConfig(c *Config) *Router {
+	r := new(Router)
+
+	for i := range c.Apps {
+		ac := &c.Apps[i]
+		r.apps = append(r.apps, &App{
+			Name:     ac.Name,
+			Hosts:    ac.Hosts,
+			Prefix:   ac.PathPrefix,
+			Launcher: NewLauncerFromConfig(ac),
+		})
+	}
+
+	return r
+}
+
+// Match picks the most specific app for the request. An app that names the
+// request host beats one that accepts any host, and a longer path prefix
+// beats a shorter one.
+func (r *Router) Match(req *http.Request) *App {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var (
+		best      *App
+		bestScore = -1
+	)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, app := range r.apps {
+		score := 0
+		if len(app.Hosts) > 0 {
+			if !app.matchHost(host) {
+				continue
+			}
+			score += 1 << 16
+		}
+		if !app.matchPath(req.URL.Path) {
+			continue
+		}
+		score += len(app.Prefix)
+
+		if score > bestScore {
+			best, bestScore = app, score
+		}
+	}
+
+	return best
+}
+
+func (r *Router) Apps() []*App {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*App(nil), r.apps...)
+}
+
+func (r *Router) App(name string) *App {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, app := range r.apps {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+func (r *Router) Start(c echo.Context) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, app := range r.apps {
+		app.Launcher.Start(c)
+	}
+}
+
+// Close closes the launchers of all apps when the launcher exits.
+func (r *Router) Close(c echo.Context) {
+	for _, app := range r.Apps() {
+		app.Launcher.Close(c)
+	}
+}
+
+// Reload applies a new config. Apps are matched by name so that existing
+// apps keep their launcher and the instances it manages. Reloading launchers
+// can call the backends, so the apps are only locked to swap them in; reloads
+// themselves are serialized by the Reloader.
+func (r *Router) Reload(c echo.Context, config *Config) {
+	current := r.Apps()
+
+	launchers := make(map[string]*Launcher, len(current))
+	for _, app := range current {
+		launchers[app.Name] = app.Launcher
+	}
+
+	apps := make([]*App, 0, len(config.Apps))
+	for i := range config.Apps {
+		ac := &config.Apps[i]
+
+		l, ok := launchers[ac.Name]
+		if ok {
+			l.Reload(c, ac)
+			delete(launchers, ac.Name)
+		} else {
+			c.Logger().Infof("Adding app %s", ac.Name)
+			l = NewLauncerFromConfig(ac)
+			l.Start(c)
+		}
+
+		apps = append(apps, &App{
+			Name:     ac.Name,
+			Hosts:    ac.Hosts,
+			Prefix:   ac.PathPrefix,
+			Launcher: l,
+		})
+	}
+
+	r.mu.Lock()
+	r.apps = apps
+	r.mu.Unlock()
+
+	for name, l := range launchers {
+		c.Logger().Warnf("Removing app %s, its instance is left running", name)
+		l.Close(c)
+	}
+}
+
+func (r *Router) Route() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			app := r.Match(c.Request())
+			if app == nil {
+				return echo.ErrNotFound
+			}
+
+			c.Set("app", app)
+			return next(c)
+		}
+	}
+}
+
+// each builds a middleware that dispatches to the middleware of the app
+// selected by Route. Apps can change on reload, so the handler is built per
+// request.
+func (r *Router) each(f func(l *Launcher) echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			app, ok := c.Get("app").(*App)
+			if !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError, "app not set")
+			}
+			return f(app.Launcher)(next)(c)
+		}
+	}
+}
+
+func (r *Router) Launch() echo.MiddlewareFunc {
+	return r.each((*Launcher).Launch)
+}
+
+func (r *Router) HandleProxyError() echo.MiddlewareFunc {
+	return r.each((*Launcher).HandleProxyError)
+}
+
+func (r *Router) Proxy() echo.MiddlewareFunc {
+	return r.each((*Launcher).Proxy)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	r := &Router{apps: []*App{
+		{Name: "default"},
+		{Name: "api", Prefix: "/api"},
+		{Name: "api-v2", Prefix: "/api/v2/"},
+		{Name: "wiki", Hosts: []string{"wiki.example.com"}},
+		{Name: "wiki-api", Hosts: []string{"wiki.example.com"}, Prefix: "/api"},
+		{Name: "tenants", Hosts: []string{"*.tenants.example.com"}},
+	}}
+
+	tests := []struct {
+		host, path string
+		app        string
+	}{
+		{"example.com", "/", "default"},
+		{"example.com", "/apis", "default"},
+		{"example.com", "/api", "api"},
+		{"example.com", "/api/", "api"},
+		{"example.com", "/api/v1/users", "api"},
+		{"example.com", "/api/v2", "api-v2"},
+		{"example.com", "/api/v2/users", "api-v2"},
+		{"example.com", "/api/v20", "api"},
+		{"wiki.example.com", "/", "wiki"},
+		{"wiki.example.com:8080", "/page", "wiki"},
+		{"WIKI.Example.com", "/", "wiki"},
+		{"wiki.example.com", "/api/pages", "wiki-api"},
+		{"wiki.example.com", "/api/v2/pages", "wiki-api"},
+		{"a.tenants.example.com", "/", "tenants"},
+		{"A.Tenants.Example.com:443", "/api", "tenants"},
+		{"tenants.example.com", "/", "default"},
+		{"[::1]:8080", "/api", "api"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		app := r.Match(req)
+		if app == nil || app.Name != tt.app {
+			t.Errorf("Match(%s%s) = %v, want %s", tt.host, tt.path, app, tt.app)
+		}
+	}
+}
+
+func TestRouterMatchNone(t *testing.T) {
+	r := &Router{apps: []*App{
+		{Name: "wiki", Hosts: []string{"wiki.example.com"}},
+		{Name: "api", Prefix: "/api"},
+	}}
+
+	for _, target := range []string{"http://example.com/", "http://example.com/apis", "http://other.example.com/wiki"} {
+		if app := r.Match(httptest.NewRequest("GET", target, nil)); app != nil {
+			t.Errorf("Match(%s) = %s, want none", target, app.Name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SessionsPageParams struct {
+	Path     string
+	Current  string
+	Csrf     string
+	Sessions []*Session
+	Error    string
+}
+
+// LogoutPage asks to log out. Logging out takes a POST with a csrf token, so
+// that other sites cannot log users out.
+func (a *Auth) LogoutPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := LogoutPageParams{
+			LoginPath: a.getConfig().AuthPath,
+			Confirm:   true,
+			Path:      c.Request().URL.Path,
+		}
+		params.Csrf, _ = c.Get("csrf").(string)
+		return c.Render(http.StatusOK, "LogoutTemplate", params)
+	}
+}
+
+// Logout revokes the session of the cookie and removes the cookie. It works
+// without a valid session, so that a stale cookie can always be removed.
+// Sessions in signed cookies cannot be revoked, which the page tells.
+func (a *Auth) Logout() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := LogoutPageParams{LoginPath: a.getConfig().AuthPath, Revoked: true}
+
+		if cookie, err := c.Cookie(authCookieName); err == nil {
+			if sts, ok := a.tokens.(*SignedTokenService); ok {
+				params.Revoked = false
+				// A copy can be extended until the session's maximum age.
+				if sess, _ := sts.decode(c, cookie.Value); sess != nil {
+					params.Expires = sess.maxExpires()
+				}
+			}
+			if err := a.tokens.Revoke(c, cookie.Value); err != nil {
+				return err
+			}
+		}
+		a.clearAuthCookie(c)
+
+		return c.Render(http.StatusOK, "LogoutTemplate", params)
+	}
+}
+
+// Sessions shows the active sessions to admins.
+func (a *Auth) Sessions() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := SessionsPageParams{
+			Path: a.getConfig().AuthPath + sessionsPath,
+		}
+		if sess, ok := c.Get("Session").(*Session); ok {
+			params.Current = sess.Id
+		}
+		params.Csrf, _ = c.Get("csrf").(string)
+
+		sessions, err := a.tokens.Sessions(c)
+		if errors.Is(err, errSessionsUnsupported) {
+			params.Error = "Sessions can't be listed with the cookie token store. Change the cookie keys to revoke all sessions."
+		} else if err != nil {
+			return err
+		}
+
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].LastSeen.After(sessions[j].LastSeen)
+		})
+		params.Sessions = sessions
+
+		return c.Render(http.StatusOK, "SessionsTemplate", params)
+	}
+}
+
+// RevokeSessions revokes the session with the id form value, or all sessions
+// of the username form value.
+func (a *Auth) RevokeSessions() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.FormValue("id")
+		username := c.FormValue("username")
+
+		var match func(s *Session) bool
+		switch {
+		case id != "":
+			match = func(s *Session) bool { return s.Id == id }
+		case username != "":
+			match = func(s *Session) bool { return strings.EqualFold(s.Username, username) }
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "id or username is required")
+		}
+
+		n, err := a.tokens.RevokeSessions(c, match)
+		if errors.Is(err, errSessionsUnsupported) {
+			return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		admin, _ := c.Get("Username").(string)
+		if id != "" {
+			c.Logger().Infof("%v revoked session %v", admin, id)
+		} else {
+			c.Logger().Infof("%v revoked %d sessions of %v", admin, n, username)
+		}
+
+		return c.Redirect(http.StatusSeeOther, a.getConfig().AuthPath+sessionsPath)
+	}
+}
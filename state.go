@@ -2,11 +2,13 @@ package main
 
 import (
 	"net/url"
-
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"time"
 )
 
 type Target struct {
-	URL      *url.URL
-	Instance *ec2.Instance
+	URL         *url.URL
+	Instance    any
+	Description string
+	// Started is when the backend started the instance, if it tells.
+	Started time.Time
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	TokenStoreMemory = "memory"
+	TokenStoreBolt   = "bolt"
+	TokenStoreRedis  = "redis"
+	TokenStoreCookie = "cookie"
+)
+
+func NewTokenServiceFromConfig(c *AuthConfig) (TokenService, error) {
+	switch c.TokenStore {
+	case TokenStoreBolt:
+		return NewBoltTokenService(c.TokenFile)
+	case TokenStoreRedis:
+		return NewRedisTokenService(c.RedisUrl)
+	case TokenStoreCookie:
+		return NewSignedTokenService(c.CookieKeys)
+	default:
+		return NewMemTokenService(), nil
+	}
+}
+
+func newTokenString() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Persistent stores only keep a hash of the token, so that a copy of the store
+// cannot be used to log in.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var tokenBucket = []byte("tokens")
+
+// BoltTokenService keeps tokens in a local file so that they survive restarts.
+// The file is locked while open, so it cannot be shared between launchers.
+type BoltTokenService struct {
+	db    *bolt.DB
+	Clock func() time.Time
+}
+
+func NewBoltTokenService(path string) (*BoltTokenService, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokenBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltTokenService{
+		db:    db,
+		Clock: time.Now,
+	}, nil
+}
+
+func (bts *BoltTokenService) NewToken(c echo.Context, username string) (string, error) {
+	token, err := newTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	sess := newSession(c, token, username, bts.Clock())
+	v, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+
+	err = bts.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucket).Put([]byte(sess.Id), v)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+
+	return token, nil
+}
+
+func (bts *BoltTokenService) Verify(c echo.Context, token string) (*Session, error) {
+	key := []byte(tokenKey(token))
+
+	var sess *Session
+	err := bts.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokenBucket).Get(key)
+		if v == nil {
+			return nil
+		}
+
+		sess = new(Session)
+		if err := json.Unmarshal(v, sess); err != nil {
+			sess = &Session{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	if sess == nil {
+		c.Logger().Debug("Token is not found")
+		return nil, nil
+	}
+
+	now := bts.Clock()
+	if now.After(sess.Expires) {
+		c.Logger().Debug("Token is expired")
+		err = bts.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(tokenBucket).Delete(key)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete token: %w", err)
+		}
+		return nil, nil
+	}
+
+	if !sess.stale(now) {
+		return sess, nil
+	}
+
+	sess.touch(c, now)
+	v, err := json.Marshal(sess)
+	if err != nil {
+		return nil, err
+	}
+	err = bts.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		// The session may have been revoked since it was read.
+		if b.Get(key) == nil {
+			sess = nil
+			return nil
+		}
+		return b.Put(key, v)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	return sess, nil
+}
+
+func (bts *BoltTokenService) Revoke(c echo.Context, token string) error {
+	return bts.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucket).Delete([]byte(tokenKey(token)))
+	})
+}
+
+func (bts *BoltTokenService) Sessions(c echo.Context) ([]*Session, error) {
+	var sessions []*Session
+
+	err := bts.db.View(func(tx *bolt.Tx) error {
+		now := bts.Clock()
+		return tx.Bucket(tokenBucket).ForEach(func(k, v []byte) error {
+			s := new(Session)
+			if err := json.Unmarshal(v, s); err == nil && !now.After(s.Expires) {
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+	})
+
+	return sessions, err
+}
+
+func (bts *BoltTokenService) RevokeSessions(c echo.Context, match func(s *Session) bool) (int, error) {
+	n := 0
+
+	err := bts.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(tokenBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil || !match(&s) {
+				continue
+			}
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+func (bts *BoltTokenService) Cleanup() error {
+	return bts.db.Update(func(tx *bolt.Tx) error {
+		now := bts.Clock()
+		cur := tx.Bucket(tokenBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil || now.After(s.Expires) {
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (bts *BoltTokenService) Close() error {
+	return bts.db.Close()
+}
+
+const redisTokenPrefix = "launcher:token:"
+
+// RedisTokenService keeps tokens in Redis, so that several launchers can
+// share sessions. Redis expires the tokens itself.
+type RedisTokenService struct {
+	client *redis.Client
+}
+
+func NewRedisTokenService(redisUrl string) (*RedisTokenService, error) {
+	opts, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+
+	return &RedisTokenService{
+		client: redis.NewClient(opts),
+	}, nil
+}
+
+func (rts *RedisTokenService) NewToken(c echo.Context, username string) (string, error) {
+	token, err := newTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	sess := newSession(c, token, username, time.Now())
+	v, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+
+	err = rts.client.Set(c.Request().Context(), redisTokenPrefix+sess.Id, v, tokenTtl).Err()
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+
+	return token, nil
+}
+
+func (rts *RedisTokenService) Verify(c echo.Context, token string) (*Session, error) {
+	ctx := c.Request().Context()
+	key := redisTokenPrefix + tokenKey(token)
+
+	v, err := rts.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.Logger().Debug("Token is not found")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	sess := new(Session)
+	if err := json.Unmarshal(v, sess); err != nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if now.After(sess.Expires) {
+		c.Logger().Debug("Token is expired")
+		return nil, nil
+	}
+	if !sess.stale(now) {
+		return sess, nil
+	}
+
+	sess.touch(c, now)
+	if v, err = json.Marshal(sess); err != nil {
+		return nil, err
+	}
+	// XX so that a session revoked in the meantime is not brought back.
+	if err := rts.client.SetXX(ctx, key, v, sess.Expires.Sub(now)).Err(); err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	return sess, nil
+}
+
+func (rts *RedisTokenService) Revoke(c echo.Context, token string) error {
+	return rts.client.Del(c.Request().Context(), redisTokenPrefix+tokenKey(token)).Err()
+}
+
+func (rts *RedisTokenService) Sessions(c echo.Context) ([]*Session, error) {
+	ctx := c.Request().Context()
+
+	var sessions []*Session
+	iter := rts.client.Scan(ctx, 0, redisTokenPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		v, err := rts.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s := new(Session)
+		if err := json.Unmarshal(v, s); err == nil {
+			sessions = append(sessions, s)
+		}
+	}
+
+	return sessions, iter.Err()
+}
+
+func (rts *RedisTokenService) RevokeSessions(c echo.Context, match func(s *Session) bool) (int, error) {
+	sessions, err := rts.Sessions(c)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range sessions {
+		if !match(s) {
+			continue
+		}
+		if err := rts.client.Del(c.Request().Context(), redisTokenPrefix+s.Id).Err(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (rts *RedisTokenService) Close() error {
+	return rts.client.Close()
+}
+
+type signedToken struct {
+	Username string `json:"u"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// SignedTokenService issues cookies that carry the session itself, signed
+// with HMAC-SHA256, so that no state is shared between launchers. Tokens are
+// signed with the first key and accepted with any of them, which allows keys
+// to be rotated without logging users out. Tokens cannot be revoked before
+// they expire, and stop being extended sessionMaxAge after the login.
+type SignedTokenService struct {
+	keys  [][]byte
+	Clock func() time.Time
+
+	// OnRefresh sets the cookie to a reissued token.
+	OnRefresh func(c echo.Context, token string)
+}
+
+func NewSignedTokenService(keys []string) (*SignedTokenService, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no cookie signing key")
+	}
+
+	sts := &SignedTokenService{Clock: time.Now}
+	for _, k := range keys {
+		sts.keys = append(sts.keys, []byte(k))
+	}
+	return sts, nil
+}
+
+func (sts *SignedTokenService) sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (sts *SignedTokenService) issue(sess *Session) (string, error) {
+	b, err := json.Marshal(signedToken{
+		Username: sess.Username,
+		IssuedAt: sess.Created.Unix(),
+		Expires:  sess.Expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + sts.sign(sts.keys[0], payload), nil
+}
+
+func (sts *SignedTokenService) NewToken(c echo.Context, username string) (string, error) {
+	now := sts.Clock()
+	return sts.issue(&Session{
+		Username: username,
+		Created:  now,
+		Expires:  now.Add(tokenTtl),
+	})
+}
+
+// decode checks the signature of the token and returns its session, and the
+// index of the key it is signed with.
+func (sts *SignedTokenService) decode(c echo.Context, token string) (*Session, int) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, -1
+	}
+
+	keyIdx := -1
+	for i, key := range sts.keys {
+		if hmac.Equal([]byte(sig), []byte(sts.sign(key, payload))) {
+			keyIdx = i
+			break
+		}
+	}
+	if keyIdx < 0 {
+		c.Logger().Debug("Token signature does not match any key")
+		return nil, -1
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, -1
+	}
+	var st signedToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, -1
+	}
+
+	return &Session{
+		Username: st.Username,
+		Created:  time.Unix(st.IssuedAt, 0),
+		Expires:  time.Unix(st.Expires, 0),
+	}, keyIdx
+}
+
+func (sts *SignedTokenService) Verify(c echo.Context, token string) (*Session, error) {
+	sess, keyIdx := sts.decode(c, token)
+	if sess == nil {
+		return nil, nil
+	}
+
+	now := sts.Clock()
+	if now.After(sess.Expires) || now.After(sess.maxExpires()) {
+		c.Logger().Debug("Token is expired")
+		return nil, nil
+	}
+
+	// Sessions are extended by reissuing the cookie once half of its lifetime
+	// has passed, or right away if it was signed with an old key.
+	if keyIdx > 0 || sess.stale(now) {
+		sess.extend(now)
+		token, err := sts.issue(sess)
+		if err != nil {
+			return nil, err
+		}
+		if sts.OnRefresh != nil {
+			sts.OnRefresh(c, token)
+		}
+	}
+
+	return sess, nil
+}
+
+// Revoke does nothing as the cookie, which is removed on logout, is the only
+// copy of the session.
+func (sts *SignedTokenService) Revoke(c echo.Context, token string) error {
+	return nil
+}
+
+func (sts *SignedTokenService) Sessions(c echo.Context) ([]*Session, error) {
+	return nil, errSessionsUnsupported
+}
+
+func (sts *SignedTokenService) RevokeSessions(c echo.Context, match func(s *Session) bool) (int, error) {
+	return 0, errSessionsUnsupported
+}
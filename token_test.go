@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func testContext() echo.Context {
+	return echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+}
+
+func newTestSignedTokens(t *testing.T, now *time.Time, keys ...string) (*SignedTokenService, *string) {
+	t.Helper()
+	sts, err := NewSignedTokenService(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sts.Clock = func() time.Time { return *now }
+	refreshed := new(string)
+	sts.OnRefresh = func(c echo.Context, token string) { *refreshed = token }
+	return sts, refreshed
+}
+
+func TestSignedTokenServiceNoKeys(t *testing.T) {
+	if _, err := NewSignedTokenService(nil); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+}
+
+func TestSignedTokenServiceVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sts, _ := newTestSignedTokens(t, &now, "key-a")
+	c := testContext()
+
+	token, err := sts.NewToken(c, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	other, _ := newTestSignedTokens(t, &now, "key-b")
+	otherToken, _ := other.NewToken(c, "alice")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"u":"admin","iat":1700000000,"exp":1700001800}`))
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", token, true},
+		{"empty", "", false},
+		{"no signature", payload, false},
+		{"empty signature", payload + ".", false},
+		{"tampered payload", forged + "." + sig, false},
+		{"tampered signature", payload + "." + strings.Repeat("A", len(sig)), false},
+		{"other key", otherToken, false},
+		{"bad payload", "!!!." + sts.sign(sts.keys[0], "!!!"), false},
+		{"bad json", "e30x." + sts.sign(sts.keys[0], "e30x"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := sts.Verify(c, tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sess != nil) != tt.valid {
+				t.Fatalf("got session %v, want valid %v", sess, tt.valid)
+			}
+			if sess != nil && sess.Username != "alice" {
+				t.Fatalf("got username %q", sess.Username)
+			}
+		})
+	}
+}
+
+func TestSignedTokenServiceExpiry(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		after     time.Duration
+		valid     bool
+		refreshed bool
+	}{
+		{"fresh", time.Minute, true, false},
+		{"before half", tokenTtl/2 - time.Second, true, false},
+		{"after half", tokenTtl/2 + time.Second, true, true},
+		{"expired", tokenTtl + time.Second, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			sts, refreshed := newTestSignedTokens(t, &now, "key-a")
+			c := testContext()
+			token, _ := sts.NewToken(c, "alice")
+
+			now = start.Add(tt.after)
+			sess, err := sts.Verify(c, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sess != nil) != tt.valid {
+				t.Fatalf("got session %v, want valid %v", sess, tt.valid)
+			}
+			if (*refreshed != "") != tt.refreshed {
+				t.Fatalf("got refreshed %q, want %v", *refreshed, tt.refreshed)
+			}
+			if *refreshed == "" {
+				return
+			}
+			sess, _ = sts.Verify(c, *refreshed)
+			if sess == nil || !sess.Expires.Equal(now.Add(tokenTtl)) {
+				t.Fatalf("reissued token has session %v", sess)
+			}
+			if !sess.Created.Equal(start) {
+				t.Fatalf("reissued token was created at %v, want %v", sess.Created, start)
+			}
+		})
+	}
+}
+
+func TestSignedTokenServiceKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := testContext()
+	old, _ := newTestSignedTokens(t, &now, "key-old")
+	token, _ := old.NewToken(c, "alice")
+
+	rotated, refreshed := newTestSignedTokens(t, &now, "key-new", "key-old")
+	sess, err := rotated.Verify(c, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess == nil {
+		t.Fatal("token signed with an old key was rejected")
+	}
+	if *refreshed == "" {
+		t.Fatal("token signed with an old key was not reissued")
+	}
+
+	current, _ := newTestSignedTokens(t, &now, "key-new")
+	if sess, _ := current.Verify(c, *refreshed); sess == nil {
+		t.Fatal("reissued token is not signed with the new key")
+	}
+	if sess, _ := current.Verify(c, token); sess != nil {
+		t.Fatal("token signed with a removed key was accepted")
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	clock := func() time.Time { return now }
+
+	mts := NewMemTokenService()
+	mts.Clock = clock
+	sts, refreshed := newTestSignedTokens(t, &now, "key-a")
+	c := testContext()
+
+	memToken, _ := mts.NewToken(c, "alice")
+	signedToken, _ := sts.NewToken(c, "alice")
+
+	// Sessions that are used every 10 minutes are extended until the maximum
+	// age, and not past it.
+	for now.Before(start.Add(sessionMaxAge)) {
+		if sess, _ := mts.Verify(c, memToken); sess == nil {
+			t.Fatalf("memory session ended after %v", now.Sub(start))
+		} else if sess.Expires.After(start.Add(sessionMaxAge)) {
+			t.Fatalf("memory session expires after its maximum age, at %v", sess.Expires)
+		}
+		if sess, _ := sts.Verify(c, signedToken); sess == nil {
+			t.Fatalf("signed session ended after %v", now.Sub(start))
+		}
+		if *refreshed != "" {
+			signedToken, *refreshed = *refreshed, ""
+		}
+		now = now.Add(10 * time.Minute)
+	}
+
+	now = start.Add(sessionMaxAge + time.Second)
+	if sess, _ := mts.Verify(c, memToken); sess != nil {
+		t.Fatal("memory session outlived its maximum age")
+	}
+	if sess, _ := sts.Verify(c, signedToken); sess != nil {
+		t.Fatal("signed session outlived its maximum age")
+	}
+
+	// A token that was issued with a later expiry, as before the maximum age
+	// was enforced, is rejected too.
+	forged, _ := sts.issue(&Session{Username: "alice", Created: start, Expires: now.Add(tokenTtl)})
+	if sess, _ := sts.Verify(c, forged); sess != nil {
+		t.Fatal("signed session past its maximum age was accepted")
+	}
+}
+
+func TestLogoutPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    string
+		revoked bool
+	}{
+		{"memory", "", true},
+		{"cookie", "  token_store: cookie\n  cookie_keys: [0123456789abcdef0123456789abcdef]\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAuth(t, "  enable: true\n  username: esh\n  password: hunter2secret\n"+tt.auth)
+			e := echo.New()
+			e.Renderer = NewPageRenderer()
+
+			token, _ := a.tokens.NewToken(testContext(), "esh")
+			req := httptest.NewRequest(http.MethodPost, "/.launcher/auth/logout", nil)
+			req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
+			rec := httptest.NewRecorder()
+			if err := a.Logout()(e.NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != authCookieName || cookies[0].MaxAge >= 0 {
+				t.Fatalf("got cookies %v, want the auth cookie removed", cookies)
+			}
+			if strings.Contains(rec.Body.String(), "stays valid") == tt.revoked {
+				t.Fatalf("page does not tell whether the session is revoked: %s", rec.Body.String())
+			}
+			sess, _ := a.tokens.Verify(testContext(), token)
+			if (sess == nil) != tt.revoked {
+				t.Fatalf("got session %v after logout, want revoked %v", sess, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestLogoutNeedsCsrf(t *testing.T) {
+	a, _ := newTestAuth(t, "  enable: true\n  username: esh\n  password: hunter2secret\n")
+	e := echo.New()
+	e.Renderer = NewPageRenderer()
+	csrf := a.CSRF("/.launcher/auth")
+	e.GET("/.launcher/auth/logout", a.LogoutPage(), csrf)
+	e.POST("/.launcher/auth/logout", a.Logout(), csrf)
+
+	token, _ := a.tokens.NewToken(testContext(), "esh")
+	logout := func(method, csrfCookie, csrfToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/.launcher/auth/logout", strings.NewReader("csrf_token="+csrfToken))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
+		if csrfCookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrfCookie})
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	valid := func() bool {
+		sess, _ := a.tokens.Verify(testContext(), token)
+		return sess != nil
+	}
+
+	rec := logout(http.MethodGet, "", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `method="POST"`) {
+		t.Fatalf("got %d %s, want the logout form", rec.Code, rec.Body.String())
+	}
+	if !valid() {
+		t.Fatal("GET logged out")
+	}
+	var csrfCookie string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			csrfCookie = c.Value
+		}
+	}
+	if csrfCookie == "" || !strings.Contains(rec.Body.String(), csrfCookie) {
+		t.Fatalf("form has no csrf token: %s", rec.Body.String())
+	}
+
+	if rec := logout(http.MethodPost, "", ""); rec.Code == http.StatusOK || !valid() {
+		t.Fatalf("POST without a csrf token got %d, want it rejected", rec.Code)
+	}
+	if rec := logout(http.MethodPost, csrfCookie, "wrong"); rec.Code == http.StatusOK || !valid() {
+		t.Fatalf("POST with a wrong csrf token got %d, want it rejected", rec.Code)
+	}
+	if rec := logout(http.MethodPost, csrfCookie, csrfCookie); rec.Code != http.StatusOK || valid() {
+		t.Fatalf("POST with the csrf token got %d, want logged out", rec.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users holds the password hashes of an htpasswd style file, one
+// "username:hash" entry per line. Hashes are bcrypt or argon2id in PHC format.
+// Usernames are case-insensitive, like they are everywhere in the launcher.
+type Users struct {
+	hashes map[string]string
+}
+
+// Checked against when the user does not exist, so that unknown users take as
+// long to reject as wrong passwords.
+var dummyHash = []byte("$2a$10$7VzP1YufKxXfduC2i4gfUe2wF9RyAek7utBPkFCqS/XdLIPQjVjlq")
+
+func LoadUsersFile(path string) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users file: %w", err)
+	}
+	defer f.Close()
+
+	users := &Users{hashes: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2id$") {
+			return nil, fmt.Errorf("%s:%d: user %s must have a bcrypt or argon2id hash", path, n, username)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: %w", path, n, username, err)
+		}
+		key := strings.ToLower(username)
+		if _, ok := users.hashes[key]; ok {
+			return nil, fmt.Errorf("%s:%d: user %s is listed twice", path, n, username)
+		}
+		users.hashes[key] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	return users, nil
+}
+
+func (u *Users) Check(username, password string) bool {
+	hash, ok := u.hashes[strings.ToLower(username)]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// secureEqual compares digests so that neither the content nor the length of
+// the secret leaks through timing.
+func secureEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+
+	argon2MaxTime   = 16
+	argon2MaxMemory = 256 * 1024
+)
+
+func HashPassword(password string, useArgon2 bool) (string, error) {
+	if !useArgon2 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkArgon2(hash, password string) bool {
+	salt, key, params, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// checkHash rejects hashes that cannot be checked, or whose argon2 parameters
+// would make each login panic or allocate an unreasonable amount of memory.
+func checkHash(hash string) error {
+	if strings.HasPrefix(hash, "$2") {
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	}
+
+	salt, key, params, err := parseArgon2(hash)
+	if err != nil {
+		return err
+	}
+	switch {
+	case params.time < 1 || params.time > argon2MaxTime:
+		return fmt.Errorf("argon2 t must be between 1 and %d", argon2MaxTime)
+	case params.threads < 1:
+		return errors.New("argon2 p must be at least 1")
+	case params.memory < 8*uint32(params.threads) || params.memory > argon2MaxMemory:
+		return fmt.Errorf("argon2 m must be between 8*p and %d KiB", argon2MaxMemory)
+	case len(salt) < 8:
+		return errors.New("argon2 salt must be at least 8 bytes")
+	case len(key) < 16:
+		return errors.New("argon2 key must be at least 16 bytes")
+	}
+	return nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2(hash string) ([]byte, []byte, argon2Params, error) {
+	var params argon2Params
+
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, params, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, params, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, nil, params, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, params, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, params, err
+	}
+
+	return salt, key, params, nil
+}
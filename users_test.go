@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testArgon2(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestParseArgon2(t *testing.T) {
+	tests := []struct {
+		name  string
+		hash  string
+		valid bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw", true},
+		{"too few parts", "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ", false},
+		{"too many parts", "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$a2V5$x", false},
+		{"old version", "$argon2id$v=16$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5", false},
+		{"bad params", "$argon2id$v=19$m=x,t=3,p=4$c2FsdHNhbHQ$a2V5", false},
+		{"p overflows", "$argon2id$v=19$m=65536,t=3,p=300$c2FsdHNhbHQ$a2V5", false},
+		{"bad salt", "$argon2id$v=19$m=65536,t=3,p=4$!!!$a2V5", false},
+		{"bad key", "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$!!!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, params, err := parseArgon2(tt.hash)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && (params.memory != 65536 || params.time != 3 || params.threads != 4) {
+				t.Fatalf("got params %+v", params)
+			}
+		})
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	salt, key := "c2FsdHNhbHQ", "a2V5a2V5a2V5a2V5a2V5aw"
+	tests := []struct {
+		name   string
+		params string
+		valid  bool
+	}{
+		{"valid", "m=65536,t=3,p=4", true},
+		{"t zero", "m=65536,t=0,p=4", false},
+		{"t too large", "m=65536,t=1000,p=4", false},
+		{"p zero", "m=65536,t=3,p=0", false},
+		{"m below 8p", "m=16,t=3,p=4", false},
+		{"m too large", "m=4294967295,t=3,p=4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHash("$argon2id$v=19$" + tt.params + "$" + salt + "$" + key)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+
+	if err := checkHash("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key); err == nil {
+		t.Fatal("short salt was accepted")
+	}
+	if err := checkHash("$argon2id$v=19$m=64,t=1,p=1$" + salt + "$a2V5"); err == nil {
+		t.Fatal("short key was accepted")
+	}
+	if err := checkHash("$2a$10$short"); err == nil {
+		t.Fatal("malformed bcrypt hash was accepted")
+	}
+}
+
+func TestUsersCheck(t *testing.T) {
+	bcryptHash, err := HashPassword("hunter2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &Users{hashes: map[string]string{
+		"bob":   bcryptHash,
+		"carol": testArgon2(t, "hunter2"),
+		"dave":  "$argon2id$v=19$m=65536,t=3,p=4$!!!$a2V5",
+	}}
+
+	tests := []struct {
+		username, password string
+		valid              bool
+	}{
+		{"bob", "hunter2", true},
+		{"bob", "hunter3", false},
+		{"bob", "", false},
+		{"Bob", "hunter2", true},
+		{"carol", "hunter2", true},
+		{"carol", "hunter3", false},
+		{"dave", "hunter2", false},
+		{"eve", "hunter2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username+"/"+tt.password, func(t *testing.T) {
+			if got := users.Check(tt.username, tt.password); got != tt.valid {
+				t.Fatalf("got %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLoadUsersFile(t *testing.T) {
+	bcryptHash, err := HashPassword("hunter2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", "# users\n\nbob:" + bcryptHash + "\n", true},
+		{"no hash", "bob\n", false},
+		{"no username", ":" + bcryptHash + "\n", false},
+		{"plain password", "bob:hunter2\n", false},
+		{"argon2 p zero", "bob:$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw\n", false},
+		{"argon2 huge m", "bob:$argon2id$v=19$m=4294967295,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5aw\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			users, err := LoadUsersFile(path)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && !strings.Contains(err.Error(), path+":") {
+				t.Fatalf("error %q does not name the line", err)
+			}
+			if users != nil && !users.Check("bob", "hunter2") {
+				t.Fatal("loaded user does not check")
+			}
+		})
+	}
+}